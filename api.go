@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/lhhong/trigger2mqtt/server"
+)
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+type deviceRequest struct {
+	Name string `json:"name"`
+}
+
+type triggerRequest struct {
+	SubType        string                 `json:"subType"`
+	SourceId       server.SourceTriggerId `json:"sourceId"`
+	Model          string                 `json:"model"`
+	IdentityFields []string               `json:"identityFields"`
+}
+
+// Only the subtype of a trigger can be changed, other fields are rejected rather than ignored.
+type triggerUpdateRequest struct {
+	SubType string `json:"subType"`
+}
+
+type pairingRequest struct {
+	DeviceId string `json:"deviceId"`
+	// Re-pairs an existing trigger if set, otherwise a new trigger is created
+	TriggerId      string   `json:"triggerId"`
+	SubType        string   `json:"subType"`
+	IdentityFields []string `json:"identityFields"`
+}
+
+// Versioned JSON API for scripted provisioning, mirroring what the htmx endpoints do.
+func registerApi(mux *http.ServeMux, config server.ConfigState, pairing server.PairingState) {
+	mux.HandleFunc("GET /api/v1/devices", func(w http.ResponseWriter, r *http.Request) {
+		writeJson(w, http.StatusOK, config.Snapshot().DevConf.Devices)
+	})
+	mux.HandleFunc("POST /api/v1/devices", func(w http.ResponseWriter, r *http.Request) {
+		var request deviceRequest
+		if !readJson(w, r, &request) {
+			return
+		}
+		if len(request.Name) == 0 {
+			writeApiError(w, errors.New("Device name is required"), http.StatusBadRequest)
+			return
+		}
+		device, err := server.AddDevice(config, request.Name)
+		if err != nil {
+			writeApiError(w, err, 0)
+			return
+		}
+		writeJson(w, http.StatusCreated, device)
+	})
+	mux.HandleFunc("GET /api/v1/devices/{deviceId}", func(w http.ResponseWriter, r *http.Request) {
+		device, err := server.GetDevice(config, r.PathValue("deviceId"))
+		if err != nil {
+			writeApiError(w, err, 0)
+			return
+		}
+		writeJson(w, http.StatusOK, device)
+	})
+	mux.HandleFunc("PATCH /api/v1/devices/{deviceId}", func(w http.ResponseWriter, r *http.Request) {
+		var request deviceRequest
+		if !readJson(w, r, &request) {
+			return
+		}
+		if len(request.Name) == 0 {
+			writeApiError(w, errors.New("Device name is required"), http.StatusBadRequest)
+			return
+		}
+		device, err := server.UpdateDevice(config, r.PathValue("deviceId"), request.Name)
+		if err != nil {
+			writeApiError(w, err, 0)
+			return
+		}
+		writeJson(w, http.StatusOK, device)
+	})
+	mux.HandleFunc("DELETE /api/v1/devices/{deviceId}", func(w http.ResponseWriter, r *http.Request) {
+		_, err := server.DeleteDevice(config, r.PathValue("deviceId"))
+		if err != nil {
+			writeApiError(w, err, 0)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	mux.HandleFunc("GET /api/v1/devices/{deviceId}/triggers", func(w http.ResponseWriter, r *http.Request) {
+		device, err := server.GetDevice(config, r.PathValue("deviceId"))
+		if err != nil {
+			writeApiError(w, err, 0)
+			return
+		}
+		writeJson(w, http.StatusOK, device.Triggers)
+	})
+	// Creates a trigger from a known source ID, use /api/v1/pairing to capture one from a remote instead
+	mux.HandleFunc("POST /api/v1/devices/{deviceId}/triggers", func(w http.ResponseWriter, r *http.Request) {
+		var request triggerRequest
+		if !readJson(w, r, &request) {
+			return
+		}
+		trigger, err := server.AddManualTrigger(
+			config,
+			r.PathValue("deviceId"),
+			request.SubType,
+			request.SourceId,
+			request.IdentityFields,
+			request.Model)
+		if err != nil {
+			writeApiError(w, err, 0)
+			return
+		}
+		writeJson(w, http.StatusCreated, trigger)
+	})
+	mux.HandleFunc("GET /api/v1/devices/{deviceId}/triggers/{triggerId}", func(w http.ResponseWriter, r *http.Request) {
+		trigger, err := server.GetTrigger(config, r.PathValue("deviceId"), r.PathValue("triggerId"))
+		if err != nil {
+			writeApiError(w, err, 0)
+			return
+		}
+		writeJson(w, http.StatusOK, trigger)
+	})
+	mux.HandleFunc("PATCH /api/v1/devices/{deviceId}/triggers/{triggerId}", func(w http.ResponseWriter, r *http.Request) {
+		var request triggerUpdateRequest
+		if !readJson(w, r, &request) {
+			return
+		}
+		trigger, err := server.UpdateTrigger(config, r.PathValue("deviceId"), r.PathValue("triggerId"), request.SubType)
+		if err != nil {
+			writeApiError(w, err, 0)
+			return
+		}
+		writeJson(w, http.StatusOK, trigger)
+	})
+	mux.HandleFunc("DELETE /api/v1/devices/{deviceId}/triggers/{triggerId}", func(w http.ResponseWriter, r *http.Request) {
+		_, err := server.DeleteTrigger(config, r.PathValue("deviceId"), r.PathValue("triggerId"))
+		if err != nil {
+			writeApiError(w, err, 0)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	// Blocks until the remote is pressed or the pairing times out, like the pairing dialog
+	mux.HandleFunc("POST /api/v1/pairing", func(w http.ResponseWriter, r *http.Request) {
+		var request pairingRequest
+		if !readJson(w, r, &request) {
+			return
+		}
+		var trigger *server.Trigger
+		var err error
+		if len(request.TriggerId) != 0 {
+			trigger, err = server.StartRepairing(request.DeviceId, request.TriggerId, config, pairing)
+		} else {
+			identityFields := request.IdentityFields
+			if len(identityFields) == 0 {
+				identityFields = server.DefaultIdentityFields(config, request.DeviceId)
+			}
+			trigger, err = server.StartPairing(request.DeviceId, request.SubType, identityFields, config, pairing)
+		}
+		if err != nil {
+			writeApiError(w, err, 0)
+			return
+		}
+		writeJson(w, http.StatusOK, trigger)
+	})
+	mux.HandleFunc("GET /api/v1/pairing", func(w http.ResponseWriter, r *http.Request) {
+		progress := server.CurrentPairingProgress(pairing)
+		if len(progress.Status) == 0 {
+			writeApiError(w, server.ErrNoPairingInProgress, 0)
+			return
+		}
+		writeJson(w, http.StatusOK, progress)
+	})
+	mux.HandleFunc("DELETE /api/v1/pairing", func(w http.ResponseWriter, r *http.Request) {
+		err := server.CancelPairing(pairing)
+		if err != nil {
+			writeApiError(w, err, 0)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+func readJson(w http.ResponseWriter, r *http.Request, request any) bool {
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(request); err != nil {
+		writeApiError(w, err, http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+func writeJson(w http.ResponseWriter, status int, body any) {
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Println("Failed to write json response: ", err)
+	}
+}
+
+// Writes the error as a json body. The status is derived from the error if not given.
+func writeApiError(w http.ResponseWriter, err error, status int) {
+	log.Println(err)
+	if status == 0 {
+		status = errorStatus(err)
+	}
+	writeJson(w, status, apiError{err.Error()})
+}
+
+func errorStatus(err error) int {
+	var duplicateSource *server.DuplicateSourceError
+	switch {
+	case errors.Is(err, server.ErrDeviceNotFound),
+		errors.Is(err, server.ErrTriggerNotFound),
+		errors.Is(err, server.ErrSignalNotFound),
+		errors.Is(err, server.ErrNoPairingInProgress):
+		return http.StatusNotFound
+	case errors.Is(err, server.ErrInvalidInput):
+		return http.StatusBadRequest
+	case errors.Is(err, server.ErrPairingInProgress),
+		errors.Is(err, server.ErrPairingCancelled),
+		errors.As(err, &duplicateSource):
+		return http.StatusConflict
+	case errors.Is(err, server.ErrModelMismatch),
+		errors.Is(err, server.ErrNoTriggerPaired):
+		return http.StatusUnprocessableEntity
+	default:
+		return http.StatusInternalServerError
+	}
+}
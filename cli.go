@@ -0,0 +1,275 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/lhhong/trigger2mqtt/server"
+)
+
+const cliUsage = `Usage: trigger2mqtt [command]
+
+Starts the server when no command is given. Commands use the same CONFIG_DIR and MQTT_BROKER as the server,
+and fail if CONFIG_DIR/devices.yml does not exist rather than creating it.
+
+Commands:
+  devices list
+  devices add --name <name>
+  devices delete --device-id <id>
+  triggers list --device-id <id>
+  triggers add --device-id <id> --sub-type <subtype> --source-id <id> --model <model> [--identity-fields <fields>]
+  triggers delete --device-id <id> --trigger-id <id>
+  config validate
+  discovery publish
+  discovery purge
+`
+
+type cliCommand func(args []string) error
+
+// Runs the command in args and returns the exit code.
+func runCli(args []string) int {
+	commands := map[string]cliCommand{
+		"devices list":      listDevicesCommand,
+		"devices add":       addDeviceCommand,
+		"devices delete":    deleteDeviceCommand,
+		"triggers list":     listTriggersCommand,
+		"triggers add":      addTriggerCommand,
+		"triggers delete":   deleteTriggerCommand,
+		"config validate":   validateConfigCommand,
+		"discovery publish": publishDiscoveryCommand,
+		"discovery purge":   purgeDiscoveryCommand,
+	}
+	if len(args) < 2 || commands[args[0]+" "+args[1]] == nil {
+		fmt.Fprint(os.Stderr, cliUsage)
+		return 2
+	}
+	err := commands[args[0]+" "+args[1]](args[2:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return 1
+	}
+	return 0
+}
+
+func parseCommandFlags(name string, args []string, define func(flags *flag.FlagSet)) error {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	define(flags)
+	return flags.Parse(args)
+}
+
+type requiredFlag struct {
+	name  string
+	value string
+}
+
+// Reports the first missing flag, in the order given.
+func requireFlags(flags ...requiredFlag) error {
+	for _, flag := range flags {
+		if len(flag.value) == 0 {
+			return fmt.Errorf("--%s is required", flag.name)
+		}
+	}
+	return nil
+}
+
+func listDevicesCommand(args []string) error {
+	if err := parseCommandFlags("devices list", args, func(flags *flag.FlagSet) {}); err != nil {
+		return err
+	}
+	config, err := server.LoadConfig()
+	if err != nil {
+		return err
+	}
+
+	table := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "ID\tNAME\tMODEL\tTRIGGERS")
+	for _, device := range config.Snapshot().DevConf.Devices {
+		fmt.Fprintf(table, "%s\t%s\t%s\t%d\n", device.Id, device.Name, device.Model, len(device.Triggers))
+	}
+	return table.Flush()
+}
+
+func addDeviceCommand(args []string) error {
+	var name string
+	if err := parseCommandFlags("devices add", args, func(flags *flag.FlagSet) {
+		flags.StringVar(&name, "name", "", "Name of the device")
+	}); err != nil {
+		return err
+	}
+	if err := requireFlags(requiredFlag{"name", name}); err != nil {
+		return err
+	}
+	config, err := server.LoadConfig()
+	if err != nil {
+		return err
+	}
+
+	device, err := server.AddDevice(config, name)
+	if err != nil {
+		return err
+	}
+	fmt.Println(device.Id)
+	return nil
+}
+
+func deleteDeviceCommand(args []string) error {
+	var deviceId string
+	if err := parseCommandFlags("devices delete", args, func(flags *flag.FlagSet) {
+		flags.StringVar(&deviceId, "device-id", "", "ID of the device")
+	}); err != nil {
+		return err
+	}
+	if err := requireFlags(requiredFlag{"device-id", deviceId}); err != nil {
+		return err
+	}
+	config, err := server.LoadConfig()
+	if err != nil {
+		return err
+	}
+
+	_, err = server.DeleteDevice(config, deviceId)
+	return err
+}
+
+func listTriggersCommand(args []string) error {
+	var deviceId string
+	if err := parseCommandFlags("triggers list", args, func(flags *flag.FlagSet) {
+		flags.StringVar(&deviceId, "device-id", "", "ID of the device")
+	}); err != nil {
+		return err
+	}
+	if err := requireFlags(requiredFlag{"device-id", deviceId}); err != nil {
+		return err
+	}
+	config, err := server.LoadConfig()
+	if err != nil {
+		return err
+	}
+
+	device, err := server.GetDevice(config, deviceId)
+	if err != nil {
+		return err
+	}
+	table := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "ID\tSUBTYPE\tSOURCE ID\tIDENTITY FIELDS")
+	for _, trigger := range device.Triggers {
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\n", trigger.Id, trigger.SubType, trigger.SourceId, strings.Join(trigger.IdentityFields, ","))
+	}
+	return table.Flush()
+}
+
+func addTriggerCommand(args []string) error {
+	var deviceId, subType, sourceId, model, identityFields string
+	if err := parseCommandFlags("triggers add", args, func(flags *flag.FlagSet) {
+		flags.StringVar(&deviceId, "device-id", "", "ID of the device")
+		flags.StringVar(&subType, "sub-type", "", "Subtype shown in HA, e.g. button_1")
+		flags.StringVar(&sourceId, "source-id", "", "Values of the identity fields joined with /, e.g. 1234/2")
+		flags.StringVar(&model, "model", "", "rtl_433 model of the remote")
+		flags.StringVar(&identityFields, "identity-fields", "id", "Comma separated rtl_433 fields making up the source ID")
+	}); err != nil {
+		return err
+	}
+	err := requireFlags(
+		requiredFlag{"device-id", deviceId},
+		requiredFlag{"sub-type", subType},
+		requiredFlag{"source-id", sourceId},
+		requiredFlag{"model", model})
+	if err != nil {
+		return err
+	}
+	config, err := server.LoadConfig()
+	if err != nil {
+		return err
+	}
+
+	trigger, err := server.AddManualTrigger(
+		config,
+		deviceId,
+		subType,
+		server.SourceTriggerId(sourceId),
+		server.ParseIdentityFields(identityFields),
+		model)
+	if err != nil {
+		return err
+	}
+	fmt.Println(trigger.Id)
+	return nil
+}
+
+func deleteTriggerCommand(args []string) error {
+	var deviceId, triggerId string
+	if err := parseCommandFlags("triggers delete", args, func(flags *flag.FlagSet) {
+		flags.StringVar(&deviceId, "device-id", "", "ID of the device")
+		flags.StringVar(&triggerId, "trigger-id", "", "ID of the trigger")
+	}); err != nil {
+		return err
+	}
+	if err := requireFlags(requiredFlag{"device-id", deviceId}, requiredFlag{"trigger-id", triggerId}); err != nil {
+		return err
+	}
+	config, err := server.LoadConfig()
+	if err != nil {
+		return err
+	}
+
+	_, err = server.DeleteTrigger(config, deviceId, triggerId)
+	return err
+}
+
+func validateConfigCommand(args []string) error {
+	if err := parseCommandFlags("config validate", args, func(flags *flag.FlagSet) {}); err != nil {
+		return err
+	}
+	validationErrors := server.ValidateConfigDir()
+	for _, err := range validationErrors {
+		fmt.Println(err)
+	}
+	if len(validationErrors) != 0 {
+		return fmt.Errorf("Found %d problems in config", len(validationErrors))
+	}
+	fmt.Println("Config is valid")
+	return nil
+}
+
+// Publishes discovery of all triggers in config and clears those of removed triggers.
+func publishDiscoveryCommand(args []string) error {
+	if err := parseCommandFlags("discovery publish", args, func(flags *flag.FlagSet) {}); err != nil {
+		return err
+	}
+	config, err := server.LoadConfig()
+	if err != nil {
+		return err
+	}
+
+	client, err := server.ConnectMqtt(config, "trigger2mqtt-cli")
+	if err != nil {
+		return err
+	}
+	defer client.Disconnect(1000)
+	server.PublishAllDiscovery(config, client)
+	server.ReconcileDiscovery(config, client)
+	return nil
+}
+
+// Removes all triggers from HA. They are published again when the server starts.
+func purgeDiscoveryCommand(args []string) error {
+	if err := parseCommandFlags("discovery purge", args, func(flags *flag.FlagSet) {}); err != nil {
+		return err
+	}
+	config, err := server.LoadConfig()
+	if err != nil {
+		return err
+	}
+
+	client, err := server.ConnectMqtt(config, "trigger2mqtt-cli")
+	if err != nil {
+		return err
+	}
+	defer client.Disconnect(1000)
+	purged := server.PurgeDiscovery(config, client)
+	fmt.Println("Cleared", purged, "discovery messages")
+	return nil
+}
@@ -1,12 +1,16 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	_ "embed"
 	"log"
 	"net/http"
+	"os"
 
 	"github.com/a-h/templ"
 	"github.com/fsnotify/fsnotify"
+	"github.com/gorilla/websocket"
 	"github.com/lhhong/trigger2mqtt/server"
 	"github.com/lhhong/trigger2mqtt/templates"
 )
@@ -14,7 +18,13 @@ import (
 //go:embed css/output.css
 var tailwind []byte
 
+var upgrader = websocket.Upgrader{}
+
 func main() {
+	if len(os.Args) > 1 {
+		os.Exit(runCli(os.Args[1:]))
+	}
+
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
 		log.Fatal("Unexpected error", err)
@@ -23,28 +33,86 @@ func main() {
 
 	config := server.InitConfig(watcher)
 	pairing := server.InitPairing()
-	client := server.InitMqtt(config, pairing)
-	defer client.Disconnect(1000)
-
-	server.PublishAllDiscovery(config, client)
+	inbox := server.InitInbox(config)
+	mqttConnection := server.InitMqtt(config, pairing, inbox)
+	defer mqttConnection.Close()
 
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Add("Content-Type", "text/html")
-		templates.RootDoc(config.DevConf.Devices).Render(r.Context(), w)
+		snapshot := config.Snapshot()
+		templates.RootDoc(snapshot.DevConf.Devices, snapshot.ValidationErrors, mqttConnection.Status()).Render(r.Context(), w)
+	})
+	http.HandleFunc("/mqtt-status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Content-Type", "text/html")
+		templates.MqttStatusBadge(mqttConnection.Status()).Render(r.Context(), w)
+	})
+	http.HandleFunc("/inbox", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Content-Type", "text/html")
+		templates.InboxDoc(inbox.Entries(), config.Snapshot().DevConf.Devices).Render(r.Context(), w)
+	})
+	http.HandleFunc("/backups", func(w http.ResponseWriter, r *http.Request) {
+		backups, err := server.ListBackups(config)
+		if err != nil {
+			log.Println("Failed to list backups: ", err)
+			w.WriteHeader(500)
+			return
+		}
+		w.Header().Add("Content-Type", "text/html")
+		templates.BackupsDoc(backups).Render(r.Context(), w)
+	})
+	http.HandleFunc("/backup-diff", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		diff, err := server.DiffBackup(config, r.Form.Get("name"))
+		if err != nil {
+			renderError(w, r, err)
+		} else {
+			w.Header().Add("Content-Type", "text/html")
+			templates.BackupDiff(diff).Render(r.Context(), w)
+		}
+	})
+	http.HandleFunc("/restore-backup", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		err := server.RestoreBackup(config, r.Form.Get("name"))
+		if err != nil {
+			renderError(w, r, err)
+		} else {
+			w.Header().Add("HX-Redirect", "/")
+		}
+	})
+	http.HandleFunc("/assign-signal", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		_, _, err := server.AssignInboxEntry(
+			config,
+			inbox,
+			r.Form.Get("key"),
+			r.Form.Get("deviceId"),
+			r.Form.Get("name"),
+			r.Form.Get("subType"))
+		if err != nil {
+			renderError(w, r, err)
+		}
+	})
+	http.HandleFunc("/dismiss-signal", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		inbox.Remove(r.Form.Get("key"))
 	})
 	http.Handle("/add-new-device", templ.Handler(templates.AddDeviceDialog()))
 	http.HandleFunc("/add-new-trigger", func(w http.ResponseWriter, r *http.Request) {
 		r.ParseForm()
 		w.Header().Add("Content-Type", "text/html")
-		templates.AddTriggerDialog(r.Form.Get("deviceId")).Render(r.Context(), w)
+		deviceId := r.Form.Get("deviceId")
+		deviceModel := ""
+		if device, err := server.GetDevice(config, deviceId); err == nil {
+			deviceModel = device.Model
+		}
+		templates.AddTriggerDialog(deviceId, deviceModel, server.DefaultIdentityFields(config, deviceId)).Render(r.Context(), w)
 	})
 	http.Handle("/empty-dialog", templ.Handler(templates.EmptyDialog()))
 	http.HandleFunc("/create-device", func(w http.ResponseWriter, r *http.Request) {
 		r.ParseForm()
 		newDevice, err := server.AddDevice(config, r.Form.Get("name"))
 		if err != nil {
-			log.Println(err)
-			w.WriteHeader(500)
+			renderError(w, r, err)
 		} else {
 			w.Header().Add("Content-Type", "text/html")
 			w.Header().Add("HX-Trigger-After-Swap", "closeDialog")
@@ -53,20 +121,186 @@ func main() {
 	})
 	http.HandleFunc("/create-trigger", func(w http.ResponseWriter, r *http.Request) {
 		r.ParseForm()
-		newTrigger, err := server.StartPairing(r.Form.Get("deviceId"), r.Form.Get("subType"), config, pairing)
+		identityFields := server.ParseIdentityFields(r.Form.Get("identityFields"))
+		newTrigger, err := server.StartPairing(r.Form.Get("deviceId"), r.Form.Get("subType"), identityFields, config, pairing)
+		if err != nil {
+			renderError(w, r, err)
+		} else {
+			w.Header().Add("Content-Type", "text/html")
+			w.Header().Add("HX-Trigger-After-Swap", "closeDialog")
+			templates.TriggerEntry(r.Form.Get("deviceId"), *newTrigger).Render(r.Context(), w)
+		}
+	})
+	http.HandleFunc("/edit-device", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		device, err := server.GetDevice(config, r.Form.Get("deviceId"))
+		if err != nil {
+			renderError(w, r, err)
+		} else {
+			w.Header().Add("Content-Type", "text/html")
+			templates.DeviceEditForm(*device).Render(r.Context(), w)
+		}
+	})
+	http.HandleFunc("/device-header", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		device, err := server.GetDevice(config, r.Form.Get("deviceId"))
+		if err != nil {
+			renderError(w, r, err)
+		} else {
+			w.Header().Add("Content-Type", "text/html")
+			templates.DeviceHeader(*device).Render(r.Context(), w)
+		}
+	})
+	http.HandleFunc("/update-device", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		device, err := server.UpdateDevice(config, r.Form.Get("deviceId"), r.Form.Get("name"))
 		if err != nil {
+			renderError(w, r, err)
+		} else {
+			w.Header().Add("Content-Type", "text/html")
+			templates.DeviceHeader(*device).Render(r.Context(), w)
+		}
+	})
+	http.HandleFunc("/edit-trigger", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		trigger, err := server.GetTrigger(config, r.Form.Get("deviceId"), r.Form.Get("triggerId"))
+		if err != nil {
+			renderError(w, r, err)
+		} else {
+			w.Header().Add("Content-Type", "text/html")
+			templates.TriggerEditForm(r.Form.Get("deviceId"), *trigger).Render(r.Context(), w)
+		}
+	})
+	http.HandleFunc("/trigger-entry", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		trigger, err := server.GetTrigger(config, r.Form.Get("deviceId"), r.Form.Get("triggerId"))
+		if err != nil {
+			renderError(w, r, err)
+		} else {
+			w.Header().Add("Content-Type", "text/html")
+			templates.TriggerEntry(r.Form.Get("deviceId"), *trigger).Render(r.Context(), w)
+		}
+	})
+	http.HandleFunc("/update-trigger", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		trigger, err := server.UpdateTrigger(config, r.Form.Get("deviceId"), r.Form.Get("triggerId"), r.Form.Get("subType"))
+		if err != nil {
+			renderError(w, r, err)
+		} else {
+			w.Header().Add("Content-Type", "text/html")
+			templates.TriggerEntry(r.Form.Get("deviceId"), *trigger).Render(r.Context(), w)
+		}
+	})
+	http.HandleFunc("/pairing-progress", func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			log.Println("Failed to upgrade pairing progress websocket: ", err)
+			return
+		}
+		defer conn.Close()
+
+		progressUpdates, unsubscribe := server.SubscribePairingProgress(pairing)
+		defer unsubscribe()
+
+		closed := make(chan bool)
+		go func() {
+			// Nothing is expected from the client, reading only notices when the dialog closes the connection
+			for {
+				if _, _, err := conn.NextReader(); err != nil {
+					close(closed)
+					return
+				}
+			}
+		}()
+
+		for {
+			select {
+			case progress := <-progressUpdates:
+				var progressHtml bytes.Buffer
+				templates.PairingProgress(progress).Render(context.Background(), &progressHtml)
+				if err := conn.WriteMessage(websocket.TextMessage, progressHtml.Bytes()); err != nil {
+					log.Println("Failed to send pairing progress: ", err)
+					return
+				}
+			case <-closed:
+				return
+			}
+		}
+	})
+	http.HandleFunc("/cancel-pairing", func(w http.ResponseWriter, r *http.Request) {
+		err := server.CancelPairing(pairing)
+		if err != nil {
+			// Dialog is closed even if pairing was not started
 			log.Println(err)
-			w.WriteHeader(500)
+		}
+		w.Header().Add("Content-Type", "text/html")
+		templates.EmptyDialog().Render(r.Context(), w)
+	})
+	http.HandleFunc("/re-pair-trigger", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		trigger, err := server.GetTrigger(config, r.Form.Get("deviceId"), r.Form.Get("triggerId"))
+		if err != nil {
+			renderError(w, r, err)
+		} else {
+			w.Header().Add("Content-Type", "text/html")
+			templates.RePairTriggerDialog(r.Form.Get("deviceId"), *trigger).Render(r.Context(), w)
+		}
+	})
+	http.HandleFunc("/update-trigger-source", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		trigger, err := server.StartRepairing(r.Form.Get("deviceId"), r.Form.Get("triggerId"), config, pairing)
+		if err != nil {
+			renderError(w, r, err)
 		} else {
-			server.PublishAllDiscovery(config, client)
 			w.Header().Add("Content-Type", "text/html")
 			w.Header().Add("HX-Trigger-After-Swap", "closeDialog")
-			templates.TriggerEntry(*newTrigger).Render(r.Context(), w)
+			templates.TriggerEntry(r.Form.Get("deviceId"), *trigger).Render(r.Context(), w)
 		}
 	})
+	http.HandleFunc("/create-manual-trigger", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		newTrigger, err := server.AddManualTrigger(
+			config,
+			r.Form.Get("deviceId"),
+			r.Form.Get("subType"),
+			server.SourceTriggerId(r.Form.Get("sourceId")),
+			server.ParseIdentityFields(r.Form.Get("identityFields")),
+			r.Form.Get("model"))
+		if err != nil {
+			renderError(w, r, err)
+		} else {
+			w.Header().Add("Content-Type", "text/html")
+			w.Header().Add("HX-Trigger-After-Swap", "closeDialog")
+			templates.TriggerEntry(r.Form.Get("deviceId"), *newTrigger).Render(r.Context(), w)
+		}
+	})
+	http.HandleFunc("/delete-device", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		_, err := server.DeleteDevice(config, r.Form.Get("deviceId"))
+		if err != nil {
+			renderError(w, r, err)
+		}
+	})
+	http.HandleFunc("/delete-trigger", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		_, err := server.DeleteTrigger(config, r.Form.Get("deviceId"), r.Form.Get("triggerId"))
+		if err != nil {
+			renderError(w, r, err)
+		}
+	})
+	registerApi(http.DefaultServeMux, config, pairing)
 	http.HandleFunc("/css/output.css", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Add("Content-Type", "text/css")
 		w.Write(tailwind)
 	})
 	log.Fatal(http.ListenAndServe(":8943", nil))
 }
+
+// htmx does not swap error responses, so errors are sent with 200 and retargeted to the error banner.
+func renderError(w http.ResponseWriter, r *http.Request, err error) {
+	log.Println(err)
+	w.Header().Add("Content-Type", "text/html")
+	w.Header().Add("HX-Retarget", "#error-message")
+	w.Header().Add("HX-Reswap", "innerHTML")
+	templates.ErrorMessage(err.Error()).Render(r.Context(), w)
+}
@@ -0,0 +1,205 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+const backupTimeFormat = "20060102-150405.000"
+
+// A copy of devices.yml taken before it was overwritten.
+type ConfigBackup struct {
+	Name string
+	Time time.Time
+	Size int64
+}
+
+type DiffOp string
+
+const (
+	DiffUnchanged DiffOp = " "
+	DiffAdded     DiffOp = "+"
+	DiffRemoved   DiffOp = "-"
+)
+
+type DiffLine struct {
+	Op   DiffOp
+	Text string
+}
+
+func getBackupDir(envVars EnvVars) string {
+	return path.Join(envVars.ConfigDir, "backups")
+}
+
+// Copies the config file into CONFIG_DIR/backups and removes the oldest backups beyond BACKUP_COUNT.
+func backupDeviceConfig(envVars EnvVars) error {
+	if envVars.BackupCount == 0 {
+		return nil
+	}
+	currentConfig, err := os.ReadFile(getDeviceConfigFile(envVars))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	backupDir := getBackupDir(envVars)
+	if err := os.MkdirAll(backupDir, 0777); err != nil {
+		return err
+	}
+	backupName := "devices-" + time.Now().Format(backupTimeFormat) + ".yml"
+	if err := os.WriteFile(path.Join(backupDir, backupName), currentConfig, 0644); err != nil {
+		return err
+	}
+
+	backups, err := listBackups(envVars)
+	if err != nil {
+		return err
+	}
+	for idx := envVars.BackupCount; idx < len(backups); idx++ {
+		if err := os.Remove(path.Join(backupDir, backups[idx].Name)); err != nil {
+			log.Println("Failed to remove old backup: ", err)
+		}
+	}
+	return nil
+}
+
+// Returns the backups, newest first.
+func ListBackups(config ConfigState) ([]ConfigBackup, error) {
+	return listBackups(config.EnvVars)
+}
+
+func listBackups(envVars EnvVars) ([]ConfigBackup, error) {
+	dirEntries, err := os.ReadDir(getBackupDir(envVars))
+	if errors.Is(err, os.ErrNotExist) {
+		return []ConfigBackup{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	backups := make([]ConfigBackup, 0, len(dirEntries))
+	for _, dirEntry := range dirEntries {
+		backupTime, ok := parseBackupName(dirEntry.Name())
+		if !ok {
+			continue
+		}
+		info, err := dirEntry.Info()
+		if err != nil {
+			continue
+		}
+		backups = append(backups, ConfigBackup{
+			Name: dirEntry.Name(),
+			Time: backupTime,
+			Size: info.Size(),
+		})
+	}
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].Time.After(backups[j].Time)
+	})
+	return backups, nil
+}
+
+func parseBackupName(name string) (time.Time, bool) {
+	if !strings.HasPrefix(name, "devices-") || !strings.HasSuffix(name, ".yml") {
+		return time.Time{}, false
+	}
+	backupTime, err := time.ParseInLocation(backupTimeFormat, name[len("devices-"):len(name)-len(".yml")], time.Local)
+	return backupTime, err == nil
+}
+
+func readBackup(envVars EnvVars, name string) ([]byte, error) {
+	// Only plain backup names are accepted so nothing outside the backup directory is read
+	if _, ok := parseBackupName(name); !ok || path.Base(name) != name {
+		return nil, fmt.Errorf("%w: %s", ErrBackupNotFound, name)
+	}
+	backup, err := os.ReadFile(path.Join(getBackupDir(envVars), name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s", ErrBackupNotFound, name)
+	}
+	return backup, err
+}
+
+// Returns the changes from the current config file to the backup, i.e. what restoring it would do.
+func DiffBackup(config ConfigState, name string) ([]DiffLine, error) {
+	backup, err := readBackup(config.EnvVars, name)
+	if err != nil {
+		return nil, err
+	}
+	currentConfig, err := os.ReadFile(getDeviceConfigFile(config.EnvVars))
+	if err != nil {
+		return nil, err
+	}
+	return diffLines(splitLines(string(currentConfig)), splitLines(string(backup))), nil
+}
+
+// Replaces the device config with the backup. The current config is backed up first so a restore can be undone.
+func RestoreBackup(config ConfigState, name string) error {
+	backup, err := readBackup(config.EnvVars, name)
+	if err != nil {
+		return err
+	}
+	// Backups may predate a format upgrade
+	restoredConf, _, err := parseDeviceConfig(backup)
+	if err != nil {
+		return fmt.Errorf("%w: backup %s is not a valid device config: %s", ErrInvalidInput, name, err)
+	}
+	_, err = config.update(func(devConf *DeviceConfig) error {
+		*devConf = *restoredConf
+		return nil
+	})
+	if err == nil {
+		log.Println("Restored device config from backup ", name)
+	}
+	return err
+}
+
+func splitLines(text string) []string {
+	return strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+}
+
+// Line diff based on the longest common subsequence, the files are small enough for the quadratic table.
+func diffLines(from []string, to []string) []DiffLine {
+	common := make([][]int, len(from)+1)
+	for i := range common {
+		common[i] = make([]int, len(to)+1)
+	}
+	for i := len(from) - 1; i >= 0; i-- {
+		for j := len(to) - 1; j >= 0; j-- {
+			if from[i] == to[j] {
+				common[i][j] = common[i+1][j+1] + 1
+			} else {
+				common[i][j] = max(common[i+1][j], common[i][j+1])
+			}
+		}
+	}
+
+	diff := make([]DiffLine, 0, max(len(from), len(to)))
+	i, j := 0, 0
+	for i < len(from) && j < len(to) {
+		switch {
+		case from[i] == to[j]:
+			diff = append(diff, DiffLine{DiffUnchanged, from[i]})
+			i++
+			j++
+		case common[i+1][j] >= common[i][j+1]:
+			diff = append(diff, DiffLine{DiffRemoved, from[i]})
+			i++
+		default:
+			diff = append(diff, DiffLine{DiffAdded, to[j]})
+			j++
+		}
+	}
+	for ; i < len(from); i++ {
+		diff = append(diff, DiffLine{DiffRemoved, from[i]})
+	}
+	for ; j < len(to); j++ {
+		diff = append(diff, DiffLine{DiffAdded, to[j]})
+	}
+	return diff
+}
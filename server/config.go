@@ -1,10 +1,13 @@
 package server
 
 import (
-	"errors"
+	"bytes"
+	"fmt"
 	"log"
 	"os"
 	"path"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/teris-io/shortid"
@@ -12,42 +15,123 @@ import (
 )
 
 type Device struct {
-	Id       string    `yml:"id"`
-	Name     string    `yml:"name"`
-	Model    string    `yml:"model"`
-	Triggers []Trigger `yml:"triggers"`
+	Id       string    `yaml:"id" json:"id"`
+	Name     string    `yaml:"name" json:"name"`
+	Model    string    `yaml:"model" json:"model"`
+	Triggers []Trigger `yaml:"triggers" json:"triggers"`
 }
 
 type SourceTriggerId string
 
 type Trigger struct {
-	Id       string          `yml:"id"`
-	SourceId SourceTriggerId `yml:"sourceId"`
-	SubType  string          `yml:"subType"`
+	Id       string          `yaml:"id" json:"id"`
+	SourceId SourceTriggerId `yaml:"sourceId" json:"sourceId"`
+	SubType  string          `yaml:"subType" json:"subType"`
+	// rtl_433 event fields whose values make up the SourceId. Empty for triggers paired by id only.
+	IdentityFields []string `yaml:"identityFields" json:"identityFields"`
 }
 
 type DeviceConfig struct {
-	Devices []Device `yml:"devices"`
+	// Format version of devices.yml, see migrations.go
+	Version int      `yaml:"version" json:"-"`
+	Devices []Device `yaml:"devices" json:"devices"`
 }
 
 type EnvVars struct {
 	HaDiscoveryPrefix string
 	ConfigDir         string
 	MqttBroker        string
+	MqttAuth          MqttAuth
+	Rtl433Topics      []string
+	DedupeWindow      time.Duration
+	PairingTimeout    time.Duration
+	BackupCount       int
+	InboxSize         int
+	InboxPersist      bool
+}
+
+// Immutable view of the device config together with the routing table built from it.
+// Each change swaps in a new snapshot, so readers always see a consistent pair without locking.
+type ConfigSnapshot struct {
+	Version  uint64
+	DevConf  DeviceConfig
+	messages mqttMessages
+	// Conflicts found in the loaded config, e.g. from hand edits of devices.yml
+	ValidationErrors []error
 }
 
 type ConfigState struct {
-	EnvVars      EnvVars
-	mqttMessages *mqttMessages
-	DevConf      *DeviceConfig
+	EnvVars   EnvVars
+	Profiles  ProfileRegistry
+	snapshot  *atomic.Pointer[ConfigSnapshot]
+	listeners *changeListeners
+	// Serializes mutations and reloads so none of them is lost
+	writeLock *sync.Mutex
+}
+
+type changeListener func(oldMessages mqttMessages, newMessages mqttMessages)
+
+type configChange struct {
+	oldMessages mqttMessages
+	newMessages mqttMessages
+}
+
+type changeListeners struct {
+	lock      sync.Mutex
+	listeners []changeListener
+	// Changes not yet passed to the listeners, in the order they were applied
+	pending   []configChange
+	notifying bool
+}
+
+// Registers a listener that is called with the previous and new mqtt messages each time the device config changes,
+// either through a mutation or an external edit of the config file.
+func (c *ConfigState) onChange(listener changeListener) {
+	c.listeners.lock.Lock()
+	defer c.listeners.lock.Unlock()
+	c.listeners.listeners = append(c.listeners.listeners, listener)
+}
+
+// Must be called with the write lock held, so changes are queued in the order they are applied.
+func (c *ConfigState) queueChange(oldMessages mqttMessages, newMessages mqttMessages) {
+	c.listeners.lock.Lock()
+	defer c.listeners.lock.Unlock()
+	c.listeners.pending = append(c.listeners.pending, configChange{oldMessages, newMessages})
+}
+
+// Passes the queued changes to the listeners. Called after releasing the write lock, as listeners may block on
+// mqtt publishes. Only one caller notifies at a time, the others leave their changes to it to keep them in order.
+func (c *ConfigState) notifyChanges() {
+	c.listeners.lock.Lock()
+	defer c.listeners.lock.Unlock()
+	if c.listeners.notifying {
+		return
+	}
+	c.listeners.notifying = true
+	for len(c.listeners.pending) > 0 {
+		change := c.listeners.pending[0]
+		c.listeners.pending = c.listeners.pending[1:]
+		listeners := c.listeners.listeners
+		c.listeners.lock.Unlock()
+		for _, listener := range listeners {
+			listener(change.oldMessages, change.newMessages)
+		}
+		c.listeners.lock.Lock()
+	}
+	c.listeners.notifying = false
 }
 
 func getDeviceConfigFile(envVars EnvVars) string {
 	return path.Join(envVars.ConfigDir, "devices.yml")
 }
 
+// Returns the current snapshot. Callers must not modify it, changes go through the mutation functions.
+func (c *ConfigState) Snapshot() *ConfigSnapshot {
+	return c.snapshot.Load()
+}
+
 func (c *ConfigState) CloneDevConf() DeviceConfig {
-	yamlConf, err := yaml.Marshal(c.DevConf)
+	yamlConf, err := yaml.Marshal(c.Snapshot().DevConf)
 	if err != nil {
 		log.Fatal("Unexpected failure", err)
 	}
@@ -59,21 +143,106 @@ func (c *ConfigState) CloneDevConf() DeviceConfig {
 	return clonedDevConf
 }
 
-func AddDevice(conf ConfigState, deviceName string) (*Device, error) {
-	newId := shortid.MustGenerate()
-	newDevice := Device{newId, deviceName, "", []Trigger{}}
+// Applies the mutation to a copy of the device config, saves it and swaps it in.
+// Nothing is changed if the mutation or the save fails.
+func (c *ConfigState) update(mutate func(devConf *DeviceConfig) error) (*ConfigSnapshot, error) {
+	defer c.notifyChanges()
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
 
-	clonedDevConf := conf.CloneDevConf()
-	clonedDevConf.Devices = append(clonedDevConf.Devices, newDevice)
-	writeDeviceConfig(getDeviceConfigFile(conf.EnvVars), clonedDevConf)
+	clonedDevConf := c.CloneDevConf()
+	if err := mutate(&clonedDevConf); err != nil {
+		return nil, err
+	}
+	if err := backupDeviceConfig(c.EnvVars); err != nil {
+		// A missing backup should not block pairing
+		log.Println("Failed to back up device config: ", err)
+	}
+	if err := writeDeviceConfig(getDeviceConfigFile(c.EnvVars), clonedDevConf); err != nil {
+		log.Println("Failed to save device config: ", err)
+		return nil, fmt.Errorf("Failed to save device config: %w", err)
+	}
+	return c.apply(clonedDevConf), nil
+}
+
+// Swaps in the device config from the file, unless it is the one we last saved.
+// The file is read with the write lock held, so a save in between cannot be overwritten by older content.
+// Returns the loaded config and the version it was saved with.
+func (c *ConfigState) reload(deviceConfigFile string) (*DeviceConfig, int, error) {
+	defer c.notifyChanges()
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
 
-	err := waitASecond(func() bool {
-		return findDevice(*conf.DevConf, newId) != nil
+	loadedConf, fileVersion, err := loadExistingConfig(deviceConfigFile)
+	if err != nil {
+		return nil, 0, err
+	}
+	if c.isCurrent(*loadedConf) {
+		log.Println("Config file unchanged, skipping reload")
+		return loadedConf, fileVersion, nil
+	}
+	c.apply(*loadedConf)
+	return loadedConf, fileVersion, nil
+}
+
+func (c *ConfigState) isCurrent(devConf DeviceConfig) bool {
+	currentYaml, err := yaml.Marshal(c.Snapshot().DevConf)
+	if err != nil {
+		return false
+	}
+	newYaml, err := yaml.Marshal(&devConf)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(currentYaml, newYaml)
+}
+
+// Must be called with the write lock held.
+func (c *ConfigState) apply(devConf DeviceConfig) *ConfigSnapshot {
+	oldSnapshot := c.Snapshot()
+	newSnapshot := &ConfigSnapshot{
+		Version:          oldSnapshot.Version + 1,
+		DevConf:          devConf,
+		messages:         devConf.toMqttMessages(c.EnvVars, c.Profiles),
+		ValidationErrors: validateLoadedConfig(devConf),
+	}
+	c.snapshot.Store(newSnapshot)
+	c.queueChange(oldSnapshot.messages, newSnapshot.messages)
+	return newSnapshot
+}
+
+func newDevice(deviceName string) Device {
+	return Device{shortid.MustGenerate(), deviceName, "", []Trigger{}}
+}
+
+func newTrigger(triggerSubType string, triggerSourceId SourceTriggerId, identityFields []string) Trigger {
+	return Trigger{
+		Id:             shortid.MustGenerate(),
+		SourceId:       triggerSourceId,
+		SubType:        triggerSubType,
+		IdentityFields: identityFields,
+	}
+}
+
+// An empty subtype would be published to HA as a trigger without a name.
+func checkSubType(triggerSubType string) error {
+	if len(triggerSubType) == 0 {
+		return fmt.Errorf("%w: subtype is required", ErrInvalidInput)
+	}
+	return nil
+}
+
+func AddDevice(conf ConfigState, deviceName string) (*Device, error) {
+	newDevice := newDevice(deviceName)
+
+	snapshot, err := conf.update(func(devConf *DeviceConfig) error {
+		devConf.Devices = append(devConf.Devices, newDevice)
+		return nil
 	})
 	if err != nil {
-		return nil, errors.New("Failed to add new device")
+		return nil, err
 	}
-	return findDevice(*conf.DevConf, newId), nil
+	return findDevice(snapshot.DevConf, newDevice.Id), nil
 }
 
 func AddTrigger(
@@ -81,40 +250,184 @@ func AddTrigger(
 	deviceId string,
 	triggerSubType string,
 	triggerSourceId SourceTriggerId,
+	identityFields []string,
 	deviceModel string) (*Trigger, error) {
-	newId := shortid.MustGenerate()
-	newTrigger := Trigger{
-		Id:       newId,
-		SourceId: triggerSourceId,
-		SubType:  triggerSubType,
+	if err := checkSubType(triggerSubType); err != nil {
+		return nil, err
+	}
+	newTrigger := newTrigger(triggerSubType, triggerSourceId, identityFields)
+
+	snapshot, err := conf.update(func(devConf *DeviceConfig) error {
+		deviceIdx := findDeviceIdx(*devConf, deviceId)
+		if deviceIdx < 0 {
+			return fmt.Errorf("%w: %s", ErrDeviceNotFound, deviceId)
+		}
+		return appendTrigger(devConf, deviceIdx, newTrigger, deviceModel)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return findTrigger(snapshot.DevConf, deviceId, newTrigger.Id), nil
+}
+
+// Adds the trigger to the device within a mutation, unless its source is already used by another trigger.
+func appendTrigger(devConf *DeviceConfig, deviceIdx int, newTrigger Trigger, deviceModel string) error {
+	newTriggerRef := toTriggerRef(devConf.Devices[deviceIdx], newTrigger)
+	err := checkSourceUnused(*devConf, deviceModel, newTrigger.getIdentityFields(), newTrigger.SourceId, newTriggerRef)
+	if err != nil {
+		return err
+	}
+	devConf.Devices[deviceIdx].Triggers = append(devConf.Devices[deviceIdx].Triggers, newTrigger)
+	devConf.Devices[deviceIdx].Model = deviceModel
+	return nil
+}
+
+func GetDevice(conf ConfigState, deviceId string) (*Device, error) {
+	device := findDevice(conf.Snapshot().DevConf, deviceId)
+	if device == nil {
+		return nil, fmt.Errorf("%w: %s", ErrDeviceNotFound, deviceId)
+	}
+	return device, nil
+}
+
+func GetTrigger(conf ConfigState, deviceId string, triggerId string) (*Trigger, error) {
+	trigger := findTrigger(conf.Snapshot().DevConf, deviceId, triggerId)
+	if trigger == nil {
+		return nil, fmt.Errorf("%w: %s", ErrTriggerNotFound, triggerId)
 	}
+	return trigger, nil
+}
+
+func UpdateDevice(conf ConfigState, deviceId string, deviceName string) (*Device, error) {
+	snapshot, err := conf.update(func(devConf *DeviceConfig) error {
+		deviceIdx := findDeviceIdx(*devConf, deviceId)
+		if deviceIdx < 0 {
+			return fmt.Errorf("%w: %s", ErrDeviceNotFound, deviceId)
+		}
+		devConf.Devices[deviceIdx].Name = deviceName
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return findDevice(snapshot.DevConf, deviceId), nil
+}
+
+// Only the subtype can be changed, the trigger ID is kept so existing HA automations continue to work.
+func UpdateTrigger(conf ConfigState, deviceId string, triggerId string, triggerSubType string) (*Trigger, error) {
+	if err := checkSubType(triggerSubType); err != nil {
+		return nil, err
+	}
+	snapshot, err := conf.update(func(devConf *DeviceConfig) error {
+		deviceIdx := findDeviceIdx(*devConf, deviceId)
+		if deviceIdx < 0 {
+			return fmt.Errorf("%w: %s", ErrDeviceNotFound, deviceId)
+		}
+		triggerIdx := findTriggerIdx(devConf.Devices[deviceIdx].Triggers, triggerId)
+		if triggerIdx < 0 {
+			return fmt.Errorf("%w: %s", ErrTriggerNotFound, triggerId)
+		}
+		devConf.Devices[deviceIdx].Triggers[triggerIdx].SubType = triggerSubType
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return findTrigger(snapshot.DevConf, deviceId, triggerId), nil
+}
 
-	clonedDevConf := conf.CloneDevConf()
-	deviceIdx := findDeviceIdx(clonedDevConf, deviceId)
-	if deviceIdx < 0 {
-		return nil, errors.New("Device not found: " + deviceId)
+func UpdateTriggerSource(
+	conf ConfigState,
+	deviceId string,
+	triggerId string,
+	triggerSourceId SourceTriggerId,
+	deviceModel string) (*Trigger, error) {
+	snapshot, err := conf.update(func(devConf *DeviceConfig) error {
+		deviceIdx := findDeviceIdx(*devConf, deviceId)
+		if deviceIdx < 0 {
+			return fmt.Errorf("%w: %s", ErrDeviceNotFound, deviceId)
+		}
+		triggerIdx := findTriggerIdx(devConf.Devices[deviceIdx].Triggers, triggerId)
+		if triggerIdx < 0 {
+			return fmt.Errorf("%w: %s", ErrTriggerNotFound, triggerId)
+		}
+		trigger := devConf.Devices[deviceIdx].Triggers[triggerIdx]
+		triggerRef := toTriggerRef(devConf.Devices[deviceIdx], trigger)
+		err := checkSourceUnused(*devConf, deviceModel, trigger.getIdentityFields(), triggerSourceId, triggerRef)
+		if err != nil {
+			return err
+		}
+		devConf.Devices[deviceIdx].Triggers[triggerIdx].SourceId = triggerSourceId
+		devConf.Devices[deviceIdx].Model = deviceModel
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
-	clonedDevConf.Devices[deviceIdx].Triggers = append(clonedDevConf.Devices[deviceIdx].Triggers, newTrigger)
-	clonedDevConf.Devices[deviceIdx].Model = deviceModel
-	writeDeviceConfig(getDeviceConfigFile(conf.EnvVars), clonedDevConf)
+	return findTrigger(snapshot.DevConf, deviceId, triggerId), nil
+}
 
-	err := waitASecond(func() bool {
-		return findTrigger(*conf.DevConf, deviceId, newId) != nil
+func DeleteDevice(conf ConfigState, deviceId string) (*Device, error) {
+	var deletedDevice Device
+	_, err := conf.update(func(devConf *DeviceConfig) error {
+		deviceIdx := findDeviceIdx(*devConf, deviceId)
+		if deviceIdx < 0 {
+			return fmt.Errorf("%w: %s", ErrDeviceNotFound, deviceId)
+		}
+		deletedDevice = devConf.Devices[deviceIdx]
+		devConf.Devices = append(devConf.Devices[:deviceIdx], devConf.Devices[deviceIdx+1:]...)
+		return nil
 	})
 	if err != nil {
-		return nil, errors.New("Failed to add new trigger")
+		return nil, err
 	}
-	return findTrigger(*conf.DevConf, deviceId, newId), nil
+	return &deletedDevice, nil
 }
 
-func waitASecond(testComplete func() bool) error {
-	for i := 0; i < 20; i++ {
-		if testComplete() {
-			return nil
+func DeleteTrigger(conf ConfigState, deviceId string, triggerId string) (*Trigger, error) {
+	var deletedTrigger Trigger
+	_, err := conf.update(func(devConf *DeviceConfig) error {
+		deviceIdx := findDeviceIdx(*devConf, deviceId)
+		if deviceIdx < 0 {
+			return fmt.Errorf("%w: %s", ErrDeviceNotFound, deviceId)
 		}
-		time.Sleep(50 * time.Millisecond)
+		triggers := devConf.Devices[deviceIdx].Triggers
+		triggerIdx := findTriggerIdx(triggers, triggerId)
+		if triggerIdx < 0 {
+			return fmt.Errorf("%w: %s", ErrTriggerNotFound, triggerId)
+		}
+		deletedTrigger = triggers[triggerIdx]
+		devConf.Devices[deviceIdx].Triggers = append(triggers[:triggerIdx], triggers[triggerIdx+1:]...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
-	return errors.New("Condition did not turn true")
+	return &deletedTrigger, nil
+}
+
+// Adds a trigger with a known source ID, e.g. from rtl_433 logs, without pairing.
+func AddManualTrigger(
+	conf ConfigState,
+	deviceId string,
+	triggerSubType string,
+	triggerSourceId SourceTriggerId,
+	identityFields []string,
+	deviceModel string) (*Trigger, error) {
+	if len(triggerSourceId) == 0 || len(deviceModel) == 0 {
+		return nil, fmt.Errorf("%w: source ID and model are required", ErrInvalidInput)
+	}
+	if err := checkSubType(triggerSubType); err != nil {
+		return nil, err
+	}
+	device := findDevice(conf.Snapshot().DevConf, deviceId)
+	if device == nil {
+		return nil, fmt.Errorf("%w: %s", ErrDeviceNotFound, deviceId)
+	}
+	if len(device.Model) != 0 && device.Model != deviceModel {
+		return nil, fmt.Errorf("%w: %s does not match device model %s", ErrModelMismatch, deviceModel, device.Model)
+	}
+	return AddTrigger(conf, deviceId, triggerSubType, triggerSourceId, identityFields, deviceModel)
 }
 
 func findDevice(conf DeviceConfig, id string) *Device {
@@ -148,10 +461,59 @@ func findTrigger(conf DeviceConfig, deviceId string, triggerId string) *Trigger
 	return nil
 }
 
-func writeDeviceConfig(configFile string, deviceConf DeviceConfig) {
-	initialConfig, err := yaml.Marshal(&deviceConf)
+func findTriggerBySource(
+	conf DeviceConfig,
+	model string,
+	identityFields []string,
+	sourceId SourceTriggerId) (*Device, *Trigger) {
+	key := getSourceKey(model, identityFields, sourceId)
+	for _, device := range conf.Devices {
+		for _, trigger := range device.Triggers {
+			if getSourceKey(device.Model, trigger.getIdentityFields(), trigger.SourceId) == key {
+				return &device, &trigger
+			}
+		}
+	}
+	return nil, nil
+}
+
+func findTriggerIdx(triggers []Trigger, triggerId string) int {
+	for idx, trigger := range triggers {
+		if trigger.Id == triggerId {
+			return idx
+		}
+	}
+	return -1
+}
+
+func writeDeviceConfig(configFile string, deviceConf DeviceConfig) error {
+	deviceConf.Version = currentConfigVersion
+	configYaml, err := yaml.Marshal(&deviceConf)
 	if err != nil {
 		log.Fatal("Unexpected failure", err)
 	}
-	os.WriteFile(configFile, initialConfig, 0666)
+	return writeFileAtomic(configFile, configYaml)
+}
+
+// Writes to a temporary file first and renames it over the file, so readers never see a partial write.
+func writeFileAtomic(file string, content []byte) error {
+	tempFile, err := os.CreateTemp(path.Dir(file), "."+path.Base(file)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempFile.Name())
+	_, err = tempFile.Write(content)
+	if err == nil {
+		err = tempFile.Sync()
+	}
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(tempFile.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tempFile.Name(), file)
 }
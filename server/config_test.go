@@ -0,0 +1,107 @@
+package server
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// Config state on an empty devices.yml in a temporary directory.
+func newTestConfig(t *testing.T) ConfigState {
+	t.Helper()
+	envVars := EnvVars{ConfigDir: t.TempDir()}
+	profiles, err := loadProfiles(getProfilesFile(envVars))
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := newConfigState(envVars, profiles)
+	initConfigFileIfNotExist(envVars.ConfigDir, getDeviceConfigFile(envVars))
+	return config
+}
+
+func TestReloadDoesNotLoseUpdates(t *testing.T) {
+	config := newTestConfig(t)
+	deviceConfigFile := getDeviceConfigFile(config.EnvVars)
+
+	done := make(chan struct{})
+	reloaded := make(chan struct{})
+	go func() {
+		defer close(reloaded)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			// As the watcher does after each save
+			if _, _, err := config.reload(deviceConfigFile); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	const deviceCount = 50
+	var wait sync.WaitGroup
+	for idx := 0; idx < deviceCount; idx++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			if _, err := AddDevice(config, "device"+strconv.Itoa(idx)); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wait.Wait()
+	close(done)
+	<-reloaded
+
+	if devices := config.Snapshot().DevConf.Devices; len(devices) != deviceCount {
+		t.Errorf("Expected %d devices, got %d", deviceCount, len(devices))
+	}
+	savedConf, _, err := loadExistingConfig(deviceConfigFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(savedConf.Devices) != deviceCount {
+		t.Errorf("Expected %d saved devices, got %d", deviceCount, len(savedConf.Devices))
+	}
+}
+
+func TestReloadAppliesExternalEdits(t *testing.T) {
+	config := newTestConfig(t)
+	deviceConfigFile := getDeviceConfigFile(config.EnvVars)
+	editedConf := DeviceConfig{Devices: []Device{newDevice("Edited")}}
+	if err := writeDeviceConfig(deviceConfigFile, editedConf); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := config.reload(deviceConfigFile); err != nil {
+		t.Fatal(err)
+	}
+	devices := config.Snapshot().DevConf.Devices
+	if len(devices) != 1 || devices[0].Name != "Edited" {
+		t.Errorf("Expected the edited device, got %+v", devices)
+	}
+}
+
+func TestEmptySubTypeRejected(t *testing.T) {
+	config := newTestConfig(t)
+	device, err := AddDevice(config, "Living room")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := AddManualTrigger(config, device.Id, "", "1234", nil, "remote"); !errors.Is(err, ErrInvalidInput) {
+		t.Errorf("Expected invalid input adding a trigger without subtype, got %v", err)
+	}
+	trigger, err := AddManualTrigger(config, device.Id, "button_1", "1234", nil, "remote")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := UpdateTrigger(config, device.Id, trigger.Id, ""); !errors.Is(err, ErrInvalidInput) {
+		t.Errorf("Expected invalid input clearing the subtype, got %v", err)
+	}
+	if saved, _ := GetTrigger(config, device.Id, trigger.Id); saved.SubType != "button_1" {
+		t.Errorf("Expected subtype to be unchanged, got %q", saved.SubType)
+	}
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+const dedupePruneInterval = time.Minute
+
+// Signals of one press, as heard by the receiver that heard it first.
+type receiverBurst struct {
+	receiver string
+	lastSeen time.Time
+}
+
+// Drops signals of a press that were also heard by another receiver, so each press reaches the gesture engine once.
+// The first receiver to hear a source owns it until it has been quiet for the dedupe window, signals from
+// other receivers are ignored meanwhile. Repeated signals from the owning receiver are kept for long presses.
+// Receivers are told apart by topic, so receivers sharing a topic can only be de-duplicated for models that do not repeat.
+type receiverDeduplicator struct {
+	lock      sync.Mutex
+	clock     clock
+	window    time.Duration
+	bursts    map[sourceKey]*receiverBurst
+	lastPrune time.Time
+	// Topics already warned about receiving duplicates
+	sharedTopics map[string]bool
+}
+
+func newReceiverDeduplicator(clock clock, window time.Duration) *receiverDeduplicator {
+	return &receiverDeduplicator{
+		clock:        clock,
+		window:       window,
+		bursts:       make(map[sourceKey]*receiverBurst),
+		lastPrune:    clock.Now(),
+		sharedTopics: make(map[string]bool),
+	}
+}
+
+// Returns whether the signal from the receiver should be processed.
+func (d *receiverDeduplicator) accept(key sourceKey, receiver string, profile ModelProfile) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	now := d.clock.Now()
+	d.prune(now)
+	window := d.window
+	if profile.Repeats {
+		// Another receiver has to take over a held button before the gesture engine considers it released
+		window = min(window, profile.ReleaseTimeout/2)
+	}
+	burst, ok := d.bursts[key]
+	if ok && now.Sub(burst.lastSeen) <= window {
+		if burst.receiver != receiver {
+			return false
+		}
+		if !profile.Repeats {
+			// Every signal is a press of its own, so a repeat this quick was heard by another receiver on the same topic
+			d.warnSharedTopic(receiver)
+			return false
+		}
+	}
+	d.bursts[key] = &receiverBurst{receiver: receiver, lastSeen: now}
+	return true
+}
+
+func (d *receiverDeduplicator) warnSharedTopic(receiver string) {
+	if d.sharedTopics[receiver] {
+		return
+	}
+	d.sharedTopics[receiver] = true
+	log.Println("Ignoring duplicate signals on", receiver, "as if several receivers publish to it,",
+		"give each receiver its own topic so held buttons are de-duplicated too")
+}
+
+// Forgets quiet sources, unmatched signals would otherwise grow the map without bound.
+func (d *receiverDeduplicator) prune(now time.Time) {
+	if now.Sub(d.lastPrune) < dedupePruneInterval {
+		return
+	}
+	d.lastPrune = now
+	for key, burst := range d.bursts {
+		if now.Sub(burst.lastSeen) > d.window {
+			delete(d.bursts, key)
+		}
+	}
+}
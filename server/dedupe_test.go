@@ -0,0 +1,73 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+type dedupeTest struct {
+	clock  *fakeClock
+	dedupe *receiverDeduplicator
+}
+
+func newDedupeTest(window time.Duration) *dedupeTest {
+	clock := newFakeClock()
+	return &dedupeTest{clock: clock, dedupe: newReceiverDeduplicator(clock, window)}
+}
+
+func (d *dedupeTest) expect(t *testing.T, offset time.Duration, receiver string, profile ModelProfile, expected bool) {
+	t.Helper()
+	d.clock.advanceTo(offset)
+	if accepted := d.dedupe.accept("key", receiver, profile); accepted != expected {
+		t.Errorf("Expected signal from %s at %v accepted to be %t", receiver, offset, expected)
+	}
+}
+
+func TestDedupeKeepsFirstReceiver(t *testing.T) {
+	test := newDedupeTest(100 * time.Millisecond)
+	profile := ModelProfile{Model: "remote"}.withDefaults()
+	test.expect(t, 0, "rtl_433/a/events", profile, true)
+	test.expect(t, 10*time.Millisecond, "rtl_433/b/events", profile, false)
+	test.expect(t, 500*time.Millisecond, "rtl_433/b/events", profile, true)
+	test.expect(t, 510*time.Millisecond, "rtl_433/a/events", profile, false)
+}
+
+func TestDedupeDropsRepeatsOnSharedTopic(t *testing.T) {
+	test := newDedupeTest(100 * time.Millisecond)
+	profile := ModelProfile{Model: "remote"}.withDefaults()
+	test.expect(t, 0, "rtl_433/events", profile, true)
+	test.expect(t, 10*time.Millisecond, "rtl_433/events", profile, false)
+	test.expect(t, 500*time.Millisecond, "rtl_433/events", profile, true)
+}
+
+func TestDedupeKeepsHeldButton(t *testing.T) {
+	test := newDedupeTest(100 * time.Millisecond)
+	profile := repeatingProfile(buttonShortPress, buttonLongPress)
+	for offset := time.Duration(0); offset < 500*time.Millisecond; offset += 50 * time.Millisecond {
+		test.expect(t, offset, "rtl_433/a/events", profile, true)
+		test.expect(t, offset+5*time.Millisecond, "rtl_433/b/events", profile, false)
+	}
+}
+
+func TestDedupeTakesOverHeldButton(t *testing.T) {
+	// Longer than the release timeout of the profile, which would otherwise end the press
+	test := newDedupeTest(time.Second)
+	profile := repeatingProfile(buttonShortPress, buttonLongPress)
+	test.expect(t, 0, "rtl_433/a/events", profile, true)
+	test.expect(t, 50*time.Millisecond, "rtl_433/b/events", profile, false)
+	// Receiver a lost the signal, b takes over well within the release timeout of 150ms
+	test.expect(t, 100*time.Millisecond, "rtl_433/b/events", profile, true)
+	test.expect(t, 120*time.Millisecond, "rtl_433/a/events", profile, false)
+	test.expect(t, 150*time.Millisecond, "rtl_433/b/events", profile, true)
+}
+
+func TestDedupePrunesQuietSources(t *testing.T) {
+	test := newDedupeTest(100 * time.Millisecond)
+	profile := ModelProfile{Model: "remote"}.withDefaults()
+	test.expect(t, 0, "rtl_433/a/events", profile, true)
+	test.clock.advanceTo(2 * dedupePruneInterval)
+	test.dedupe.accept("other", "rtl_433/a/events", profile)
+	if len(test.dedupe.bursts) != 1 {
+		t.Errorf("Expected quiet sources to be pruned, got %d", len(test.dedupe.bursts))
+	}
+}
@@ -0,0 +1,16 @@
+package server
+
+import "errors"
+
+var (
+	ErrDeviceNotFound      = errors.New("Device not found")
+	ErrTriggerNotFound     = errors.New("Trigger not found")
+	ErrSignalNotFound      = errors.New("Signal not found in inbox")
+	ErrBackupNotFound      = errors.New("Backup not found")
+	ErrInvalidInput        = errors.New("Invalid input")
+	ErrModelMismatch       = errors.New("Model mismatch")
+	ErrPairingInProgress   = errors.New("Another pairing in progress")
+	ErrNoPairingInProgress = errors.New("No pairing in progress")
+	ErrPairingCancelled    = errors.New("Pairing cancelled")
+	ErrNoTriggerPaired     = errors.New("No triggers paired")
+)
@@ -0,0 +1,206 @@
+package server
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// Abstracts time so the gesture engine can be driven deterministically.
+type clock interface {
+	Now() time.Time
+	AfterFunc(d time.Duration, f func()) timer
+}
+
+type timer interface {
+	Stop() bool
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) timer {
+	return time.AfterFunc(d, f)
+}
+
+type gestureState struct {
+	discovery triggerMessages
+	// Topic of the receiver of the latest signal, for tracing activations
+	receiver string
+
+	// Current press, made up of the repeated signals of a held button
+	pressing      bool
+	firstSignal   time.Time
+	signals       uint
+	sentLongPress bool
+	releaseTimer  timer
+	releaseGen    uint64
+
+	// Completed presses waiting on the multi press window
+	presses         uint
+	multiPressTimer timer
+	multiPressGen   uint64
+}
+
+// Turns rtl_433 signals into short, long, release and multi presses according to the model profile of each trigger.
+// Triggers are sent through emit, which is called with the engine lock held so it must not block.
+type gestureEngine struct {
+	lock   sync.Mutex
+	clock  clock
+	states map[sourceKey]*gestureState
+	emit   func(discovery triggerMessages, triggerType string, receiver string)
+}
+
+func newGestureEngine(clock clock, emit func(discovery triggerMessages, triggerType string, receiver string)) *gestureEngine {
+	return &gestureEngine{
+		clock:  clock,
+		states: make(map[sourceKey]*gestureState),
+		emit:   emit,
+	}
+}
+
+func (e *gestureEngine) signal(triggerKey sourceKey, discovery triggerMessages, receiver string) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	state, ok := e.states[triggerKey]
+	if !ok {
+		state = &gestureState{}
+		e.states[triggerKey] = state
+	}
+	state.discovery = discovery
+	state.receiver = receiver
+	profile := discovery.profile
+
+	if !profile.Repeats {
+		// Every signal is a press of its own
+		e.completePress(triggerKey, state)
+		e.cleanUp(triggerKey, state)
+		return
+	}
+
+	now := e.clock.Now()
+	if !state.pressing {
+		// The multi press window restarts once this press completes, so a slow second press is not cut off
+		e.stopMultiPressTimer(state)
+		state.pressing = true
+		state.firstSignal = now
+		state.signals = 1
+		state.sentLongPress = false
+	} else {
+		state.signals++
+		shouldSendLongPress := profile.supports(buttonLongPress) &&
+			!state.sentLongPress &&
+			state.firstSignal.Add(profile.HoldThreshold).Before(now)
+		if shouldSendLongPress {
+			log.Println("Starting long press")
+			e.flushPresses(state)
+			e.emit(state.discovery, buttonLongPress, state.receiver)
+			state.sentLongPress = true
+		}
+	}
+
+	if state.releaseTimer != nil {
+		state.releaseTimer.Stop()
+	}
+	state.releaseGen++
+	releaseGen := state.releaseGen
+	state.releaseTimer = e.clock.AfterFunc(profile.ReleaseTimeout, func() {
+		e.release(triggerKey, releaseGen)
+	})
+}
+
+func (e *gestureEngine) release(triggerKey sourceKey, releaseGen uint64) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	state, ok := e.states[triggerKey]
+	if !ok || !state.pressing || state.releaseGen != releaseGen {
+		// Superseded by a later signal
+		return
+	}
+	profile := state.discovery.profile
+	log.Println("No trigger response after ", profile.ReleaseTimeout)
+	state.pressing = false
+	state.releaseTimer = nil
+
+	if state.sentLongPress {
+		if profile.supports(buttonLongRelease) {
+			e.emit(state.discovery, buttonLongRelease, state.receiver)
+		}
+	} else if state.signals >= profile.MinSignals {
+		e.completePress(triggerKey, state)
+	} else {
+		log.Println("Only received", state.signals, "signals for trigger, ignoring")
+		if state.presses > 0 {
+			e.startMultiPressTimer(triggerKey, state)
+		}
+	}
+	e.cleanUp(triggerKey, state)
+}
+
+// Counts a completed short press and sends it once no further press follows within the multi press window.
+func (e *gestureEngine) completePress(triggerKey sourceKey, state *gestureState) {
+	profile := state.discovery.profile
+	maxPresses := profile.maxPresses()
+	if maxPresses <= 1 {
+		e.emit(state.discovery, buttonShortPress, state.receiver)
+		return
+	}
+
+	state.presses++
+	if state.presses >= maxPresses {
+		// No point waiting when no higher press count is supported
+		e.flushPresses(state)
+		return
+	}
+	e.startMultiPressTimer(triggerKey, state)
+}
+
+func (e *gestureEngine) startMultiPressTimer(triggerKey sourceKey, state *gestureState) {
+	e.stopMultiPressTimer(state)
+	multiPressGen := state.multiPressGen
+	state.multiPressTimer = e.clock.AfterFunc(state.discovery.profile.MultiPressWindow, func() {
+		e.endMultiPress(triggerKey, multiPressGen)
+	})
+}
+
+func (e *gestureEngine) stopMultiPressTimer(state *gestureState) {
+	if state.multiPressTimer != nil {
+		state.multiPressTimer.Stop()
+		state.multiPressTimer = nil
+	}
+	state.multiPressGen++
+}
+
+func (e *gestureEngine) endMultiPress(triggerKey sourceKey, multiPressGen uint64) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	state, ok := e.states[triggerKey]
+	if !ok || state.multiPressGen != multiPressGen || state.pressing {
+		// Superseded by a later press
+		return
+	}
+	log.Println("No further press after ", state.discovery.profile.MultiPressWindow)
+	e.flushPresses(state)
+	e.cleanUp(triggerKey, state)
+}
+
+// Sends any presses waiting on the multi press window right away.
+func (e *gestureEngine) flushPresses(state *gestureState) {
+	e.stopMultiPressTimer(state)
+	if state.presses > 0 {
+		e.emit(state.discovery, state.discovery.profile.pressType(state.presses), state.receiver)
+		state.presses = 0
+	}
+}
+
+func (e *gestureEngine) cleanUp(triggerKey sourceKey, state *gestureState) {
+	if !state.pressing && state.presses == 0 {
+		delete(e.states, triggerKey)
+	}
+}
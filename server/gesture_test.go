@@ -0,0 +1,261 @@
+package server
+
+import (
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeTimer struct {
+	clock   *fakeClock
+	at      time.Time
+	f       func()
+	stopped bool
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.lock.Lock()
+	defer t.clock.lock.Unlock()
+	wasActive := !t.stopped
+	t.stopped = true
+	return wasActive
+}
+
+// Clock that only moves when advanced, firing due timers in order outside of its lock.
+type fakeClock struct {
+	lock   sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Unix(0, 0)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) AfterFunc(d time.Duration, f func()) timer {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	t := &fakeTimer{clock: c, at: c.now.Add(d), f: f}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+// Moves the clock to the given offset from its start.
+func (c *fakeClock) advanceTo(offset time.Duration) {
+	target := time.Unix(0, 0).Add(offset)
+	for {
+		c.lock.Lock()
+		sort.SliceStable(c.timers, func(i, j int) bool {
+			return c.timers[i].at.Before(c.timers[j].at)
+		})
+		var due *fakeTimer
+		for idx, t := range c.timers {
+			if t.stopped {
+				continue
+			}
+			if !t.at.After(target) {
+				due = t
+				c.timers = c.timers[idx+1:]
+			}
+			break
+		}
+		if due == nil {
+			c.now = target
+			c.lock.Unlock()
+			return
+		}
+		due.stopped = true
+		c.now = due.at
+		c.lock.Unlock()
+		due.f()
+	}
+}
+
+type gestureTest struct {
+	clock    *fakeClock
+	engine   *gestureEngine
+	lock     sync.Mutex
+	triggers []string
+}
+
+func newGestureTest() *gestureTest {
+	test := &gestureTest{clock: newFakeClock()}
+	test.engine = newGestureEngine(test.clock, func(discovery triggerMessages, triggerType string, receiver string) {
+		test.lock.Lock()
+		defer test.lock.Unlock()
+		test.triggers = append(test.triggers, triggerType)
+	})
+	return test
+}
+
+// Sends a signal every 50ms from start to end, as a remote does while a button is held.
+func (g *gestureTest) hold(profile ModelProfile, start time.Duration, end time.Duration) {
+	discovery := triggerMessages{triggerId: "trigger", profile: profile}
+	for offset := start; offset <= end; offset += 50 * time.Millisecond {
+		g.clock.advanceTo(offset)
+		g.engine.signal("key", discovery, "rtl_433/events")
+	}
+}
+
+func (g *gestureTest) expect(t *testing.T, end time.Duration, expected ...string) {
+	t.Helper()
+	g.clock.advanceTo(end)
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if expected == nil {
+		expected = []string{}
+	}
+	triggers := append([]string{}, g.triggers...)
+	if !reflect.DeepEqual(triggers, expected) {
+		t.Errorf("Expected triggers %v, got %v", expected, triggers)
+	}
+	if len(g.engine.states) != 0 {
+		t.Errorf("Expected no gesture state left, got %d", len(g.engine.states))
+	}
+}
+
+func repeatingProfile(triggerTypes ...string) ModelProfile {
+	return ModelProfile{
+		Model:          "remote",
+		Repeats:        true,
+		TriggerTypes:   triggerTypes,
+		IdentityFields: defaultIdentityFields,
+	}.withDefaults()
+}
+
+func TestShortPress(t *testing.T) {
+	test := newGestureTest()
+	profile := repeatingProfile(buttonShortPress, buttonLongPress, buttonLongRelease)
+	test.hold(profile, 0, 100*time.Millisecond)
+	test.expect(t, time.Second, buttonShortPress)
+}
+
+func TestLongPressAndRelease(t *testing.T) {
+	test := newGestureTest()
+	profile := repeatingProfile(buttonShortPress, buttonLongPress, buttonLongRelease)
+	test.hold(profile, 0, 600*time.Millisecond)
+	test.expect(t, time.Second, buttonLongPress, buttonLongRelease)
+}
+
+func TestLongPressWithoutRelease(t *testing.T) {
+	test := newGestureTest()
+	profile := repeatingProfile(buttonShortPress, buttonLongPress)
+	test.hold(profile, 0, 600*time.Millisecond)
+	test.expect(t, time.Second, buttonLongPress)
+}
+
+func TestMinSignalsIgnoresNoise(t *testing.T) {
+	test := newGestureTest()
+	profile := repeatingProfile(buttonShortPress)
+	profile.MinSignals = 3
+	test.hold(profile, 0, 50*time.Millisecond)
+	test.expect(t, time.Second)
+	test.hold(profile, 2*time.Second, 2100*time.Millisecond)
+	test.expect(t, 3*time.Second, buttonShortPress)
+}
+
+func TestNonRepeatingPresses(t *testing.T) {
+	test := newGestureTest()
+	profile := ModelProfile{Model: "remote"}.withDefaults()
+	test.hold(profile, 0, 0)
+	test.hold(profile, 100*time.Millisecond, 100*time.Millisecond)
+	test.expect(t, time.Second, buttonShortPress, buttonShortPress)
+}
+
+func TestDoublePress(t *testing.T) {
+	test := newGestureTest()
+	profile := repeatingProfile(buttonShortPress, buttonDoublePress)
+	test.hold(profile, 0, 100*time.Millisecond)
+	test.hold(profile, 350*time.Millisecond, 550*time.Millisecond)
+	test.expect(t, 2*time.Second, buttonDoublePress)
+}
+
+func TestSlowSecondPressWaitsForRelease(t *testing.T) {
+	test := newGestureTest()
+	profile := repeatingProfile(buttonShortPress, buttonDoublePress, buttonTriplePress)
+	test.hold(profile, 0, 100*time.Millisecond)
+	// Held past the multi press window of the first press, but shorter than the hold threshold
+	test.hold(profile, 500*time.Millisecond, 750*time.Millisecond)
+	test.expect(t, 3*time.Second, buttonDoublePress)
+}
+
+func TestPressesOutsideMultiPressWindow(t *testing.T) {
+	test := newGestureTest()
+	profile := repeatingProfile(buttonShortPress, buttonDoublePress)
+	test.hold(profile, 0, 100*time.Millisecond)
+	test.hold(profile, time.Second, 1100*time.Millisecond)
+	test.expect(t, 3*time.Second, buttonShortPress, buttonShortPress)
+}
+
+func TestTriplePressSentWithoutWaiting(t *testing.T) {
+	test := newGestureTest()
+	profile := repeatingProfile(buttonShortPress, buttonDoublePress, buttonTriplePress)
+	test.hold(profile, 0, 50*time.Millisecond)
+	test.hold(profile, 300*time.Millisecond, 350*time.Millisecond)
+	test.hold(profile, 600*time.Millisecond, 650*time.Millisecond)
+	// Released at 800ms, no multi press window is needed after the highest supported count
+	test.expect(t, 800*time.Millisecond, buttonTriplePress)
+}
+
+func TestLongPressSendsPendingPresses(t *testing.T) {
+	test := newGestureTest()
+	profile := repeatingProfile(buttonShortPress, buttonDoublePress, buttonLongPress, buttonLongRelease)
+	test.hold(profile, 0, 100*time.Millisecond)
+	test.hold(profile, 350*time.Millisecond, time.Second)
+	test.expect(t, 2*time.Second, buttonShortPress, buttonLongPress, buttonLongRelease)
+}
+
+func TestNoiseKeepsPendingPresses(t *testing.T) {
+	test := newGestureTest()
+	profile := repeatingProfile(buttonShortPress, buttonDoublePress)
+	profile.MinSignals = 2
+	test.hold(profile, 0, 100*time.Millisecond)
+	test.hold(profile, 300*time.Millisecond, 300*time.Millisecond)
+	test.expect(t, 2*time.Second, buttonShortPress)
+}
+
+// Run with -race.
+func TestConcurrentSignals(t *testing.T) {
+	engine := newGestureEngine(realClock{}, func(discovery triggerMessages, triggerType string, receiver string) {})
+	profile := repeatingProfile(buttonShortPress, buttonDoublePress, buttonLongPress)
+	discovery := triggerMessages{triggerId: "trigger", profile: profile}
+	var wait sync.WaitGroup
+	for idx := 0; idx < 4; idx++ {
+		wait.Add(1)
+		// Presses on different remotes as well as on the same one
+		triggerKey := sourceKey("key" + strconv.Itoa(idx%2))
+		go func() {
+			defer wait.Done()
+			for signal := 0; signal < 50; signal++ {
+				engine.signal(triggerKey, discovery, "rtl_433/events")
+				time.Sleep(time.Millisecond)
+			}
+		}()
+	}
+	wait.Wait()
+}
+
+func TestActivationKeepsReceiver(t *testing.T) {
+	clock := newFakeClock()
+	var receivers []string
+	engine := newGestureEngine(clock, func(discovery triggerMessages, triggerType string, receiver string) {
+		receivers = append(receivers, receiver)
+	})
+	discovery := triggerMessages{triggerId: "trigger", profile: ModelProfile{Model: "remote"}.withDefaults()}
+	engine.signal("key", discovery, "rtl_433/a/events")
+	clock.advanceTo(time.Second)
+	engine.signal("key", discovery, "rtl_433/b/events")
+	clock.advanceTo(2 * time.Second)
+	if !reflect.DeepEqual(receivers, []string{"rtl_433/a/events", "rtl_433/b/events"}) {
+		t.Errorf("Expected activations from receivers a and b, got %v", receivers)
+	}
+}
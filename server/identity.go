@@ -0,0 +1,102 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+	"strings"
+)
+
+// Used for triggers without identity fields, which were paired using only the rtl_433 id.
+var defaultIdentityFields = []string{"id"}
+
+// Fields commonly emitted by rtl_433 decoders to tell apart remotes and their buttons.
+var IdentityFieldCandidates = []string{"id", "channel", "button", "cmd", "unit", "code"}
+
+type SourceTriggerMessage struct {
+	Model  string
+	Fields map[string]string
+	// Topic the event was received on, which tells apart rtl_433 receivers
+	Receiver string
+}
+
+// Key used to route an rtl_433 event to a trigger. Built from the model, the identity fields and their values.
+type sourceKey string
+
+// rtl_433 decoders emit identity fields as either strings or numbers, all scalar values are kept as strings.
+func parseSourceTriggerMessage(payload []byte) (SourceTriggerMessage, error) {
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.UseNumber()
+	var rawFields map[string]interface{}
+	if err := decoder.Decode(&rawFields); err != nil {
+		return SourceTriggerMessage{}, err
+	}
+
+	fields := make(map[string]string)
+	for key, value := range rawFields {
+		switch value := value.(type) {
+		case string:
+			fields[key] = value
+		case json.Number:
+			fields[key] = value.String()
+		case bool:
+			fields[key] = strconv.FormatBool(value)
+		}
+	}
+	return SourceTriggerMessage{
+		Model:  fields["model"],
+		Fields: fields,
+	}, nil
+}
+
+// Joins the values of the identity fields into a source ID. Returns false if the message is missing any of the fields.
+func (m SourceTriggerMessage) sourceId(identityFields []string) (SourceTriggerId, bool) {
+	values := make([]string, 0, len(identityFields))
+	for _, field := range identityFields {
+		value, ok := m.Fields[field]
+		if !ok {
+			return "", false
+		}
+		values = append(values, value)
+	}
+	return SourceTriggerId(strings.Join(values, "/")), true
+}
+
+// Key of a message by the identity fields of its model profile, for messages not matching any trigger.
+func (m SourceTriggerMessage) profileSourceKey(profiles ProfileRegistry) (sourceKey, bool) {
+	identityFields := profiles.forModel(m.Model).IdentityFields
+	sourceId, ok := m.sourceId(identityFields)
+	if !ok {
+		return "", false
+	}
+	return getSourceKey(m.Model, identityFields, sourceId), true
+}
+
+func getSourceKey(model string, identityFields []string, sourceId SourceTriggerId) sourceKey {
+	return sourceKey(model + "|" + strings.Join(identityFields, ",") + "|" + string(sourceId))
+}
+
+func (t Trigger) getIdentityFields() []string {
+	if len(t.IdentityFields) == 0 {
+		return defaultIdentityFields
+	}
+	return t.IdentityFields
+}
+
+// Parses a comma separated list of identity fields, e.g. "id, button".
+func ParseIdentityFields(fields string) []string {
+	identityFields := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, field := range strings.Split(fields, ",") {
+		field = strings.TrimSpace(field)
+		if len(field) == 0 || seen[field] {
+			continue
+		}
+		seen[field] = true
+		identityFields = append(identityFields, field)
+	}
+	if len(identityFields) == 0 {
+		return defaultIdentityFields
+	}
+	return identityFields
+}
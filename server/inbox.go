@@ -0,0 +1,246 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// An rtl_433 signal that did not match any trigger.
+type InboxEntry struct {
+	Key            string          `yaml:"key"`
+	Model          string          `yaml:"model"`
+	IdentityFields []string        `yaml:"identityFields"`
+	SourceId       SourceTriggerId `yaml:"sourceId"`
+	FirstSeen      time.Time       `yaml:"firstSeen"`
+	LastSeen       time.Time       `yaml:"lastSeen"`
+	Count          uint            `yaml:"count"`
+	// rtl_433 topics the signal was received on
+	Receivers []string `yaml:"receivers"`
+}
+
+type inboxFile struct {
+	Entries []InboxEntry `yaml:"entries"`
+}
+
+// Bounded collection of recently seen unmatched signals, so they can be assigned to a device without pairing.
+type SignalInbox struct {
+	lock        sync.Mutex
+	entries     map[string]*InboxEntry
+	capacity    int
+	persistFile string
+	dirty       bool
+}
+
+const inboxPersistInterval = 10 * time.Second
+
+func getInboxFile(envVars EnvVars) string {
+	return path.Join(envVars.ConfigDir, "inbox.yml")
+}
+
+// The inbox is kept in CONFIG_DIR/inbox.yml across restarts if INBOX_PERSIST is true.
+func InitInbox(config ConfigState) *SignalInbox {
+	inbox := &SignalInbox{
+		entries:  make(map[string]*InboxEntry),
+		capacity: config.EnvVars.InboxSize,
+	}
+
+	if config.EnvVars.InboxPersist {
+		inbox.persistFile = getInboxFile(config.EnvVars)
+		inbox.load()
+		go inbox.persistPeriodically()
+	}
+	return inbox
+}
+
+func (i *SignalInbox) record(sourceMessage SourceTriggerMessage, profiles ProfileRegistry) {
+	identityFields := profiles.forModel(sourceMessage.Model).IdentityFields
+	sourceId, ok := sourceMessage.sourceId(identityFields)
+	if !ok {
+		log.Println("Unmatched signal without identity fields: ", sourceMessage.Model, " ", identityFields)
+		return
+	}
+	key := string(getSourceKey(sourceMessage.Model, identityFields, sourceId))
+	now := time.Now()
+
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	i.dirty = true
+	entry, ok := i.entries[key]
+	if ok {
+		entry.LastSeen = now
+		entry.Count++
+		entry.Receivers = addReceiver(entry.Receivers, sourceMessage.Receiver)
+		return
+	}
+	if len(i.entries) >= i.capacity {
+		i.evictOldest()
+	}
+	i.entries[key] = &InboxEntry{
+		Key:            key,
+		Model:          sourceMessage.Model,
+		IdentityFields: identityFields,
+		SourceId:       sourceId,
+		FirstSeen:      now,
+		LastSeen:       now,
+		Count:          1,
+		Receivers:      addReceiver([]string{}, sourceMessage.Receiver),
+	}
+}
+
+func addReceiver(receivers []string, receiver string) []string {
+	for _, known := range receivers {
+		if known == receiver {
+			return receivers
+		}
+	}
+	return append(receivers, receiver)
+}
+
+func (i *SignalInbox) evictOldest() {
+	var oldest *InboxEntry
+	for _, entry := range i.entries {
+		if oldest == nil || entry.LastSeen.Before(oldest.LastSeen) {
+			oldest = entry
+		}
+	}
+	if oldest != nil {
+		delete(i.entries, oldest.Key)
+	}
+}
+
+// Returns the entries, most recently seen first.
+func (i *SignalInbox) Entries() []InboxEntry {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	entries := make([]InboxEntry, 0, len(i.entries))
+	for _, entry := range i.entries {
+		entries = append(entries, *entry)
+	}
+	sort.Slice(entries, func(a, b int) bool {
+		return entries[a].LastSeen.After(entries[b].LastSeen)
+	})
+	return entries
+}
+
+func (i *SignalInbox) get(key string) (InboxEntry, bool) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	entry, ok := i.entries[key]
+	if !ok {
+		return InboxEntry{}, false
+	}
+	return *entry, true
+}
+
+func (i *SignalInbox) Remove(key string) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	i.dirty = true
+	delete(i.entries, key)
+}
+
+// Creates a trigger for the inbox entry on an existing device, or on a new device if deviceId is empty.
+func AssignInboxEntry(
+	config ConfigState,
+	inbox *SignalInbox,
+	key string,
+	deviceId string,
+	newDeviceName string,
+	triggerSubType string) (*Device, *Trigger, error) {
+	entry, ok := inbox.get(key)
+	if !ok {
+		return nil, nil, fmt.Errorf("%w: %s", ErrSignalNotFound, key)
+	}
+
+	if err := checkSubType(triggerSubType); err != nil {
+		return nil, nil, err
+	}
+	var addedDevice *Device
+	if len(deviceId) == 0 {
+		if len(newDeviceName) == 0 {
+			return nil, nil, fmt.Errorf("%w: name of the new device is required", ErrInvalidInput)
+		}
+		device := newDevice(newDeviceName)
+		addedDevice = &device
+		deviceId = device.Id
+	}
+
+	// The new device and its trigger are saved together, so a rejected trigger leaves no empty device behind
+	newTrigger := newTrigger(triggerSubType, entry.SourceId, entry.IdentityFields)
+	snapshot, err := config.update(func(devConf *DeviceConfig) error {
+		if addedDevice != nil {
+			devConf.Devices = append(devConf.Devices, *addedDevice)
+		}
+		deviceIdx := findDeviceIdx(*devConf, deviceId)
+		if deviceIdx < 0 {
+			return fmt.Errorf("%w: %s", ErrDeviceNotFound, deviceId)
+		}
+		if model := devConf.Devices[deviceIdx].Model; len(model) != 0 && model != entry.Model {
+			return fmt.Errorf("%w: signal model %s does not match device model %s", ErrModelMismatch, entry.Model, model)
+		}
+		return appendTrigger(devConf, deviceIdx, newTrigger, entry.Model)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	inbox.Remove(key)
+	return findDevice(snapshot.DevConf, deviceId), findTrigger(snapshot.DevConf, deviceId, newTrigger.Id), nil
+}
+
+func (i *SignalInbox) load() {
+	inboxLoad, err := os.ReadFile(i.persistFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	if err != nil {
+		log.Println("Failed to read inbox", err)
+		return
+	}
+	var loadedInbox inboxFile
+	err = yaml.Unmarshal(inboxLoad, &loadedInbox)
+	if err != nil {
+		log.Println("Failed to unmarshal inbox", err)
+		return
+	}
+	for idx := range loadedInbox.Entries {
+		entry := loadedInbox.Entries[idx]
+		if len(i.entries) >= i.capacity {
+			i.evictOldest()
+		}
+		i.entries[entry.Key] = &entry
+	}
+}
+
+func (i *SignalInbox) persistPeriodically() {
+	for range time.Tick(inboxPersistInterval) {
+		i.lock.Lock()
+		if !i.dirty {
+			i.lock.Unlock()
+			continue
+		}
+		i.dirty = false
+		entries := make([]InboxEntry, 0, len(i.entries))
+		for _, entry := range i.entries {
+			entries = append(entries, *entry)
+		}
+		i.lock.Unlock()
+
+		inboxYaml, err := yaml.Marshal(inboxFile{entries})
+		if err != nil {
+			log.Println("Failed to marshal inbox", err)
+			continue
+		}
+		err = writeFileAtomic(i.persistFile, inboxYaml)
+		if err != nil {
+			log.Println("Failed to write inbox", err)
+		}
+	}
+}
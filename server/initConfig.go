@@ -2,12 +2,17 @@ package server
 
 import (
 	"errors"
+	"fmt"
 	"log"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
-	"gopkg.in/yaml.v2"
 )
 
 func InitConfig(watcher *fsnotify.Watcher) ConfigState {
@@ -17,21 +22,50 @@ func InitConfig(watcher *fsnotify.Watcher) ConfigState {
 
 	initConfigFileIfNotExist(envVars.ConfigDir, deviceConfigFile)
 
-	var config ConfigState = ConfigState{
-		EnvVars:      envVars,
-		mqttMessages: &mqttMessages{},
-		DevConf:      &DeviceConfig{[]Device{}}}
+	profiles, err := loadProfiles(getProfilesFile(envVars))
+	if err != nil {
+		log.Fatal("Failed to load model profiles: ", err)
+	}
+
+	config := newConfigState(envVars, profiles)
 
-	watchConfigFile(deviceConfigFile, watcher, config)
+	watchConfigFile(envVars.ConfigDir, deviceConfigFile, watcher, config)
 
-	loadedConf, err := loadExistingConfig(deviceConfigFile)
+	loadedConf, fileVersion, err := config.reload(deviceConfigFile)
 	if err != nil {
 		log.Fatal("Failed initial config load: ", err)
 	}
-	mqttMessages := loadedConf.toMqttMessages(envVars)
-	*(config.DevConf) = *loadedConf
-	*(config.mqttMessages) = *&mqttMessages
+	if fileVersion < currentConfigVersion {
+		upgradeConfigFile(envVars, *loadedConf, fileVersion)
+	}
+
+	return config
+}
+
+// Loads the config in CONFIG_DIR for CLI commands. Unlike InitConfig, devices.yml is not created, upgraded or watched,
+// so nothing is written unless the config is changed. Fails if devices.yml does not exist.
+func LoadConfig() (ConfigState, error) {
+	envVars := getEnvVars()
+	profiles, err := loadProfiles(getProfilesFile(envVars))
+	if err != nil {
+		return ConfigState{}, fmt.Errorf("Invalid model profiles: %w", err)
+	}
+	config := newConfigState(envVars, profiles)
+	if _, _, err := config.reload(getDeviceConfigFile(envVars)); err != nil {
+		return ConfigState{}, fmt.Errorf("Invalid device config: %w", err)
+	}
+	return config, nil
+}
 
+// Config state with an empty device config, until it is loaded with reload.
+func newConfigState(envVars EnvVars, profiles ProfileRegistry) ConfigState {
+	config := ConfigState{
+		EnvVars:   envVars,
+		Profiles:  profiles,
+		snapshot:  &atomic.Pointer[ConfigSnapshot]{},
+		listeners: &changeListeners{},
+		writeLock: &sync.Mutex{}}
+	config.snapshot.Store(&ConfigSnapshot{DevConf: DeviceConfig{Devices: []Device{}}})
 	return config
 }
 
@@ -48,10 +82,55 @@ func getEnvVars() EnvVars {
 	if len(mqttBroker) == 0 {
 		mqttBroker = "mqtt://127.0.0.1:1883"
 	}
+	insecureSkipVerify, _ := strconv.ParseBool(os.Getenv("MQTT_INSECURE_SKIP_VERIFY"))
+	mqttAuth := MqttAuth{
+		Username:           os.Getenv("MQTT_USERNAME"),
+		Password:           os.Getenv("MQTT_PASSWORD"),
+		PasswordFile:       os.Getenv("MQTT_PASSWORD_FILE"),
+		CaFile:             os.Getenv("MQTT_CA_FILE"),
+		ClientCertFile:     os.Getenv("MQTT_CLIENT_CERT_FILE"),
+		ClientKeyFile:      os.Getenv("MQTT_CLIENT_KEY_FILE"),
+		InsecureSkipVerify: insecureSkipVerify,
+	}
+	rtl433Topics := make([]string, 0)
+	for _, topic := range strings.Split(os.Getenv("RTL433_TOPICS"), ",") {
+		if topic = strings.TrimSpace(topic); len(topic) != 0 {
+			rtl433Topics = append(rtl433Topics, topic)
+		}
+	}
+	if len(rtl433Topics) == 0 {
+		// Topic of older setups, and the default topic of rtl_433 which includes the hostname
+		rtl433Topics = []string{"rtl_433/events", "rtl_433/+/events"}
+	}
+	dedupeWindow, err := time.ParseDuration(os.Getenv("DEDUPE_WINDOW"))
+	if err != nil || dedupeWindow < 0 {
+		// Kept below the default release timeout, see receiverDeduplicator
+		dedupeWindow = 100 * time.Millisecond
+	}
+	pairingTimeout, err := time.ParseDuration(os.Getenv("PAIRING_TIMEOUT"))
+	if err != nil || pairingTimeout <= 0 {
+		pairingTimeout = 20 * time.Second
+	}
+	backupCount, err := strconv.Atoi(os.Getenv("BACKUP_COUNT"))
+	if err != nil || backupCount < 0 {
+		backupCount = 20
+	}
+	inboxSize, err := strconv.Atoi(os.Getenv("INBOX_SIZE"))
+	if err != nil || inboxSize <= 0 {
+		inboxSize = 50
+	}
+	inboxPersist, _ := strconv.ParseBool(os.Getenv("INBOX_PERSIST"))
 	return EnvVars{
 		HaDiscoveryPrefix: haDiscoveryPrefix,
 		ConfigDir:         configDir,
 		MqttBroker:        mqttBroker,
+		MqttAuth:          mqttAuth,
+		Rtl433Topics:      rtl433Topics,
+		DedupeWindow:      dedupeWindow,
+		PairingTimeout:    pairingTimeout,
+		BackupCount:       backupCount,
+		InboxSize:         inboxSize,
+		InboxPersist:      inboxPersist,
 	}
 }
 
@@ -59,12 +138,15 @@ func initConfigFileIfNotExist(configDir string, deviceConfigFile string) {
 	_, err := os.Stat(deviceConfigFile)
 	if errors.Is(err, os.ErrNotExist) {
 		os.MkdirAll(configDir, 0777)
-		writeDeviceConfig(deviceConfigFile, DeviceConfig{[]Device{}})
+		if err := writeDeviceConfig(deviceConfigFile, DeviceConfig{Devices: []Device{}}); err != nil {
+			log.Fatal("Failed to create device config: ", err)
+		}
 	}
 }
 
-func watchConfigFile(deviceConfigFile string, watcher *fsnotify.Watcher, config ConfigState) {
-	err := watcher.Add(deviceConfigFile)
+// Reloads the config on external edits of the config file. The directory is watched as the file is replaced on save.
+func watchConfigFile(configDir string, deviceConfigFile string, watcher *fsnotify.Watcher, config ConfigState) {
+	err := watcher.Add(configDir)
 	if err != nil {
 		log.Fatal("Unexpected error", err)
 	}
@@ -76,16 +158,17 @@ func watchConfigFile(deviceConfigFile string, watcher *fsnotify.Watcher, config
 				if !ok {
 					return
 				}
+				if filepath.Clean(event.Name) != filepath.Clean(deviceConfigFile) ||
+					!event.Has(fsnotify.Write) && !event.Has(fsnotify.Create) {
+					continue
+				}
 				log.Println("Config file watcher event", event)
 				for i := 0; i < 15; i++ {
 					// A little sleep time and retries otherwise it throws file not found due to racey conditions
 					time.Sleep(30 * time.Millisecond)
-					loadedConfig, err := loadExistingConfig(deviceConfigFile)
-					if err != nil {
+					if _, _, err := config.reload(deviceConfigFile); err != nil {
 						log.Println("Failed to reload config: ", err)
 					} else {
-						*config.DevConf = *loadedConfig
-						*config.mqttMessages = (*loadedConfig).toMqttMessages(config.EnvVars)
 						break
 					}
 				}
@@ -99,17 +182,50 @@ func watchConfigFile(deviceConfigFile string, watcher *fsnotify.Watcher, config
 	}(config)
 }
 
-func loadExistingConfig(deviceConfigFile string) (*DeviceConfig, error) {
+// Checks profiles.yml and devices.yml in CONFIG_DIR without starting anything.
+func ValidateConfigDir() []error {
+	envVars := getEnvVars()
+	validationErrors := make([]error, 0)
+	if _, err := loadProfiles(getProfilesFile(envVars)); err != nil {
+		validationErrors = append(validationErrors, fmt.Errorf("Invalid model profiles: %w", err))
+	}
+	deviceConf, _, err := loadExistingConfig(getDeviceConfigFile(envVars))
+	if err != nil {
+		return append(validationErrors, fmt.Errorf("Invalid device config: %w", err))
+	}
+	return append(validationErrors, validateDeviceConfig(*deviceConf)...)
+}
+
+func validateLoadedConfig(deviceConf DeviceConfig) []error {
+	validationErrors := validateDeviceConfig(deviceConf)
+	for _, err := range validationErrors {
+		log.Println("Invalid device config: ", err)
+	}
+	return validationErrors
+}
+
+// Returns the config upgraded to the current format, and the version it was saved with.
+func loadExistingConfig(deviceConfigFile string) (*DeviceConfig, int, error) {
 	log.Println("Loading config from: ", deviceConfigFile)
 	deviceConfLoad, err := os.ReadFile(deviceConfigFile)
 	if err != nil {
 		log.Println("Failed to read device config", err)
-		return nil, err
+		return nil, 0, err
 	}
-	var deviceConf DeviceConfig
-	err = yaml.Unmarshal(deviceConfLoad, &deviceConf)
+	deviceConf, fileVersion, err := parseDeviceConfig(deviceConfLoad)
 	if err != nil {
 		log.Println("Failed to unmarshal device config", err)
 	}
-	return &deviceConf, err
+	return deviceConf, fileVersion, err
+}
+
+// Saves the config in the current format, keeping a backup of the old file.
+func upgradeConfigFile(envVars EnvVars, deviceConf DeviceConfig, fileVersion int) {
+	log.Println("Upgrading device config from version", fileVersion, "to", currentConfigVersion)
+	if err := backupDeviceConfig(envVars); err != nil {
+		log.Fatal("Failed to back up device config before upgrading: ", err)
+	}
+	if err := writeDeviceConfig(getDeviceConfigFile(envVars), deviceConf); err != nil {
+		log.Fatal("Failed to save upgraded device config: ", err)
+	}
 }
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"fmt"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Version of the devices.yml format written by this build. Bump it together with a new migration.
+const currentConfigVersion = 1
+
+type rawConfig = map[interface{}]interface{}
+
+// Migrations upgrade the raw config from the version of their index to the next one.
+var configMigrations = []func(rawConf rawConfig) error{
+	migrateFieldNameKeys,
+}
+
+// Parses devices.yml of any supported version, upgrading it to the current format.
+// Returns the version the file was written with, so callers can persist the upgrade.
+func parseDeviceConfig(configYaml []byte) (*DeviceConfig, int, error) {
+	rawConf := make(rawConfig)
+	if err := yaml.Unmarshal(configYaml, &rawConf); err != nil {
+		return nil, 0, err
+	}
+	fileVersion := 0
+	if version, ok := rawConf["version"]; ok {
+		fileVersion, ok = version.(int)
+		if !ok {
+			return nil, 0, fmt.Errorf("Invalid config version: %v", version)
+		}
+	}
+	if fileVersion > currentConfigVersion {
+		return nil, 0, fmt.Errorf("Config version %d is newer than the supported version %d", fileVersion, currentConfigVersion)
+	}
+
+	for version := fileVersion; version < currentConfigVersion; version++ {
+		if err := configMigrations[version](rawConf); err != nil {
+			return nil, 0, fmt.Errorf("Failed to migrate config from version %d: %w", version, err)
+		}
+	}
+	rawConf["version"] = currentConfigVersion
+
+	migratedYaml, err := yaml.Marshal(rawConf)
+	if err != nil {
+		return nil, 0, err
+	}
+	var deviceConf DeviceConfig
+	if err := yaml.Unmarshal(migratedYaml, &deviceConf); err != nil {
+		return nil, 0, err
+	}
+	return &deviceConf, fileVersion, nil
+}
+
+// Version 0 had no yaml tags, so keys were the lowercased Go field names.
+func migrateFieldNameKeys(rawConf rawConfig) error {
+	devices, _ := rawConf["devices"].([]interface{})
+	for _, device := range devices {
+		device, ok := device.(rawConfig)
+		if !ok {
+			return fmt.Errorf("Unexpected device entry: %v", device)
+		}
+		triggers, _ := device["triggers"].([]interface{})
+		for _, trigger := range triggers {
+			trigger, ok := trigger.(rawConfig)
+			if !ok {
+				return fmt.Errorf("Unexpected trigger entry: %v", trigger)
+			}
+			renameKey(trigger, "sourceid", "sourceId")
+			renameKey(trigger, "subtype", "subType")
+			renameKey(trigger, "identityfields", "identityFields")
+		}
+	}
+	return nil
+}
+
+func renameKey(rawConf rawConfig, from string, to string) {
+	if value, ok := rawConf[from]; ok {
+		delete(rawConf, from)
+		rawConf[to] = value
+	}
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseUnversionedConfig(t *testing.T) {
+	configYaml := `devices:
+- id: device1
+  name: Living room
+  model: Brandless remote
+  triggers:
+  - id: trigger1
+    sourceid: "1234"
+    subtype: button_1
+  - id: trigger2
+    sourceid: 1234/2
+    subtype: button_2
+    identityfields:
+    - id
+    - button
+`
+	deviceConf, fileVersion, err := parseDeviceConfig([]byte(configYaml))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fileVersion != 0 {
+		t.Errorf("Expected file version 0, got %d", fileVersion)
+	}
+	expected := &DeviceConfig{
+		Version: currentConfigVersion,
+		Devices: []Device{{
+			Id:    "device1",
+			Name:  "Living room",
+			Model: "Brandless remote",
+			Triggers: []Trigger{
+				{Id: "trigger1", SourceId: "1234", SubType: "button_1"},
+				{Id: "trigger2", SourceId: "1234/2", SubType: "button_2", IdentityFields: []string{"id", "button"}},
+			},
+		}},
+	}
+	if !reflect.DeepEqual(deviceConf, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, deviceConf)
+	}
+}
+
+func TestParseCurrentConfig(t *testing.T) {
+	configYaml := `version: 1
+devices:
+- id: device1
+  name: Living room
+  model: Brandless remote
+  triggers:
+  - id: trigger1
+    sourceId: "1234"
+    subType: button_1
+    identityFields: []
+`
+	deviceConf, fileVersion, err := parseDeviceConfig([]byte(configYaml))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fileVersion != currentConfigVersion {
+		t.Errorf("Expected file version %d, got %d", currentConfigVersion, fileVersion)
+	}
+	trigger := deviceConf.Devices[0].Triggers[0]
+	if trigger.SourceId != "1234" || trigger.SubType != "button_1" {
+		t.Errorf("Unexpected trigger %+v", trigger)
+	}
+}
+
+func TestParseEmptyConfig(t *testing.T) {
+	deviceConf, fileVersion, err := parseDeviceConfig([]byte(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fileVersion != 0 || len(deviceConf.Devices) != 0 {
+		t.Errorf("Unexpected config %+v of version %d", deviceConf, fileVersion)
+	}
+}
+
+func TestParseInvalidConfigVersion(t *testing.T) {
+	for _, configYaml := range []string{"version: 99\ndevices: []\n", "version: one\ndevices: []\n"} {
+		if _, _, err := parseDeviceConfig([]byte(configYaml)); err == nil {
+			t.Errorf("Expected an error for %q", configYaml)
+		}
+	}
+}
+
+func TestMigrateFieldNameKeysRejectsMalformedDevices(t *testing.T) {
+	rawConf := rawConfig{"devices": []interface{}{"device1"}}
+	if err := migrateFieldNameKeys(rawConf); err == nil {
+		t.Error("Expected an error for a device that is not a map")
+	}
+}
@@ -2,166 +2,235 @@ package server
 
 import (
 	"encoding/json"
+	"errors"
 	"log"
-	"math/rand"
+	"math/rand/v2"
+	"reflect"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
-	"github.com/puzpuzpuz/xsync"
 )
 
-type SourceTriggerMessage struct {
-	Id    SourceTriggerId `json:"id"`
-	Model string          `json:"model"`
-}
+const rootTopic string = "trigger2mqtt"
+
+// Retained online/offline state of the bridge, set to offline by the broker through the last will if we die.
+const availabilityTopic string = rootTopic + "/bridge/availability"
+const payloadOnline = "online"
+const payloadOffline = "offline"
+
+var bridgeAvailability = []AvailabilityMessage{{
+	Topic:               availabilityTopic,
+	PayloadAvailable:    payloadOnline,
+	PayloadNotAvailable: payloadOffline,
+}}
+
+var buttonShortPress = "button_short_press"
+var buttonLongPress = "button_long_press"
+var buttonLongRelease = "button_long_release"
+var buttonDoublePress = "button_double_press"
+var buttonTriplePress = "button_triple_press"
+var buttonQuadruplePress = "button_quadruple_press"
+var buttonQuintuplePress = "button_quintuple_press"
 
-type triggerLongHoldState struct {
-	triggerHash    int
-	firstTriggered time.Time
-	sentLongPress  bool
-	count          uint
+// Trigger types sent for consecutive presses, indexed by the number of presses minus one
+var multiPressTypes = []string{buttonShortPress, buttonDoublePress, buttonTriplePress, buttonQuadruplePress, buttonQuintuplePress}
+
+var knownTriggerTypes = []string{
+	buttonShortPress,
+	buttonLongPress,
+	buttonLongRelease,
+	buttonDoublePress,
+	buttonTriplePress,
+	buttonQuadruplePress,
+	buttonQuintuplePress,
 }
 
-type longHoldStates struct {
-	triggers map[SourceTriggerId]triggerLongHoldState
-	locks    *xsync.MapOf[SourceTriggerId, *sync.Mutex]
+func isKnownTriggerType(triggerType string) bool {
+	for _, knownType := range knownTriggerTypes {
+		if knownType == triggerType {
+			return true
+		}
+	}
+	return false
 }
 
-var longHold longHoldStates = longHoldStates{
-	triggers: make(map[SourceTriggerId]triggerLongHoldState),
-	locks:    xsync.NewTypedMapOf[SourceTriggerId, *sync.Mutex](func (id SourceTriggerId) uint64 {
-		return xsync.StrHash64(string(id))
-	}),
+func getDiscoveryNodeTopic(envVars EnvVars) string {
+	return envVars.HaDiscoveryPrefix + "/device_automation/rtl_433"
 }
 
-const rootTopic string = "trigger2mqtt"
+// Home Assistant publishes its birth message here when it starts.
+func getHaStatusTopic(envVars EnvVars) string {
+	return envVars.HaDiscoveryPrefix + "/status"
+}
 
-var buttonShortPress = "button_short_press"
-var buttonLongPress = "button_long_press"
-var buttonLongRelease = "button_long_release"
+func getDiscoveryTopic(envVars EnvVars, triggerId string, triggerType string) discoveryTopic {
+	return getDiscoveryNodeTopic(envVars) + "/" + triggerId + "_" + triggerType + "/config"
+}
 
-func (devConf *DeviceConfig) toMqttMessages(envVars EnvVars) mqttMessages {
-	triggerMap := make(map[SourceTriggerId]triggerMessages)
+func (devConf *DeviceConfig) toMqttMessages(envVars EnvVars, profiles ProfileRegistry) mqttMessages {
+	triggerMap := make(map[sourceKey]triggerMessages)
+	identityFieldSets := make(map[string][]string)
 	for _, device := range devConf.Devices {
 		deviceDiscoveryMessage := DeviceDiscoveryMessage{
 			Identifiers: device.Id,
 			Name:        device.Name,
 			Model:       device.Model,
 		}
-		holdSupported := device.Model == "Brandless remote"
+		profile := profiles.forModel(device.Model)
 		for _, trigger := range device.Triggers {
-			if _, seen := triggerMap[trigger.SourceId]; seen {
+			identityFields := trigger.getIdentityFields()
+			triggerKey := getSourceKey(device.Model, identityFields, trigger.SourceId)
+			if _, seen := triggerMap[triggerKey]; seen {
+				// Reported by validateDeviceConfig
 				log.Println("Found duplicated trigger sourceId. Only using the first defined value.")
 				continue
 			}
 			var triggerTopic = rootTopic + "/" + trigger.Id
 			var triggerDiscoveryMessages = make(map[discoveryTopic]DiscoveryMessage)
-			triggerDiscoveryMessages[envVars.HaDiscoveryPrefix+"/device_automation/rtl_433/"+trigger.Id+"_"+buttonShortPress+"/config"] =
-				DiscoveryMessage{
-					AutomationType: "trigger",
-					Type:           buttonShortPress,
-					Payload:        &buttonShortPress,
-					SubType:        trigger.SubType,
-					Topic:          triggerTopic,
-					Device:         deviceDiscoveryMessage,
-				}
-			if holdSupported {
-				triggerDiscoveryMessages[envVars.HaDiscoveryPrefix+"/device_automation/rtl_433/"+trigger.Id+"_"+buttonLongPress+"/config"] =
-					DiscoveryMessage{
-						AutomationType: "trigger",
-						Type:           buttonLongPress,
-						Payload:        &buttonLongPress,
-						SubType:        trigger.SubType,
-						Topic:          triggerTopic,
-						Device:         deviceDiscoveryMessage,
-					}
-				triggerDiscoveryMessages[envVars.HaDiscoveryPrefix+"/device_automation/rtl_433/"+trigger.Id+"_"+buttonLongRelease+"/config"] =
+			for _, triggerType := range profile.TriggerTypes {
+				payload := triggerType
+				triggerDiscoveryMessages[getDiscoveryTopic(envVars, trigger.Id, triggerType)] =
 					DiscoveryMessage{
 						AutomationType: "trigger",
-						Type:           buttonLongRelease,
-						Payload:        &buttonLongRelease,
+						Type:           triggerType,
+						Payload:        &payload,
 						SubType:        trigger.SubType,
 						Topic:          triggerTopic,
 						Device:         deviceDiscoveryMessage,
+						Availability:   bridgeAvailability,
 					}
 			}
 
-			triggerMap[trigger.SourceId] = triggerMessages{
+			identityFieldSets[strings.Join(identityFields, ",")] = identityFields
+			triggerMap[triggerKey] = triggerMessages{
 				triggerId:         trigger.Id,
 				triggerTopic:      triggerTopic,
-				holdSupported:     holdSupported,
+				profile:           profile,
 				discoveryMessages: triggerDiscoveryMessages,
 			}
 		}
 	}
 
+	identities := make([][]string, 0, len(identityFieldSets))
+	for _, identityFields := range identityFieldSets {
+		identities = append(identities, identityFields)
+	}
+	// Try the most specific identities first so a trigger for a single button wins over one for the whole remote
+	sort.Slice(identities, func(i, j int) bool {
+		if len(identities[i]) != len(identities[j]) {
+			return len(identities[i]) > len(identities[j])
+		}
+		return strings.Join(identities[i], ",") < strings.Join(identities[j], ",")
+	})
+
 	return mqttMessages{
-		triggers: triggerMap,
+		triggers:   triggerMap,
+		identities: identities,
 	}
 }
 
-func InitMqtt(config ConfigState, pairing PairingState) mqtt.Client {
-	opts := mqtt.NewClientOptions()
-	opts.AddBroker(config.EnvVars.MqttBroker)
-	opts.SetClientID("trigger2mqtt")
-	opts.SetOrderMatters(false)
-	client := mqtt.NewClient(opts)
-	if token := client.Connect(); !token.WaitTimeout(1*time.Second) || token.Error() != nil {
-		panic(token.Error())
-	}
-	if token := client.Subscribe("rtl_433/events", 1, rtl433EventHandler(config.mqttMessages, pairing)); !token.WaitTimeout(1*time.Second) || token.Error() != nil {
-		log.Println("Failed to Subscribe to rtl_433 events")
-	} else {
-		log.Println("Subscribed to rtl_433 events")
+// Connects in the background so the UI is available while the broker is down.
+// On every (re)connect, rtl_433 events are subscribed again and discovery is republished.
+func InitMqtt(config ConfigState, pairing PairingState, inbox *SignalInbox) *MqttConnection {
+	connection := newMqttConnection()
+	opts, err := newMqttClientOptions(config.EnvVars, "trigger2mqtt")
+	if err != nil {
+		log.Fatal("Invalid MQTT options: ", err)
 	}
 
-	PublishAllDiscovery(config, client)
+	var eventHandler mqtt.MessageHandler
+	opts.SetWill(availabilityTopic, payloadOffline, 1, true)
+	opts.SetAutoReconnect(true)
+	opts.SetMaxReconnectInterval(maxConnectBackoff)
+	opts.SetOnConnectHandler(func(client mqtt.Client) {
+		log.Println("Connected to MQTT broker")
+		connection.setStatus(MqttConnected, nil)
+		publishAvailability(client, payloadOnline)
+		eventFilters := make(map[string]byte)
+		for _, topic := range config.EnvVars.Rtl433Topics {
+			eventFilters[topic] = 1
+		}
+		if token := client.SubscribeMultiple(eventFilters, eventHandler); !token.WaitTimeout(1*time.Second) || token.Error() != nil {
+			log.Println("Failed to Subscribe to rtl_433 events")
+		} else {
+			log.Println("Subscribed to rtl_433 events on", config.EnvVars.Rtl433Topics)
+		}
+		if token := client.Subscribe(getHaStatusTopic(config.EnvVars), 1, haStatusHandler(config)); !token.WaitTimeout(1*time.Second) || token.Error() != nil {
+			log.Println("Failed to subscribe to Home Assistant status")
+		}
+		// Changes made while disconnected are caught up on here
+		PublishAllDiscovery(config, client)
+		ReconcileDiscovery(config, client)
+	})
+	opts.SetConnectionLostHandler(func(client mqtt.Client, err error) {
+		log.Println("Lost connection to MQTT broker: ", err)
+		connection.setStatus(MqttDisconnected, err)
+	})
+	opts.SetReconnectingHandler(func(client mqtt.Client, opts *mqtt.ClientOptions) {
+		log.Println("Reconnecting to MQTT broker")
+		connection.setStatus(MqttConnecting, nil)
+	})
 
-	return client
+	client := mqtt.NewClient(opts)
+	gestures := newGestureEngine(realClock{}, startTriggerPublisher(client))
+	dedupe := newReceiverDeduplicator(realClock{}, config.EnvVars.DedupeWindow)
+	eventHandler = rtl433EventHandler(config, pairing, gestures, dedupe, inbox)
+	connection.Client = client
+
+	config.onChange(func(oldMessages mqttMessages, newMessages mqttMessages) {
+		publishDiscoveryDiff(client, oldMessages, newMessages)
+	})
+
+	go connection.connectWithBackoff(config.EnvVars.MqttBroker)
+	return connection
 }
 
-func rtl433EventHandler(mqttRoutes *mqttMessages, pairing PairingState) mqtt.MessageHandler {
+// Connects to the broker without subscribing to anything. Client IDs must be unique, so the CLI connects with its own.
+func ConnectMqtt(config ConfigState, clientId string) (mqtt.Client, error) {
+	opts, err := newMqttClientOptions(config.EnvVars, clientId)
+	if err != nil {
+		return nil, err
+	}
+	client := mqtt.NewClient(opts)
+	if token := client.Connect(); !token.WaitTimeout(connectTimeout) {
+		return nil, errors.New("Timed out connecting to " + config.EnvVars.MqttBroker)
+	} else if token.Error() != nil {
+		return nil, token.Error()
+	}
+	return client, nil
+}
+
+func rtl433EventHandler(
+	config ConfigState,
+	pairing PairingState,
+	gestures *gestureEngine,
+	dedupe *receiverDeduplicator,
+	inbox *SignalInbox) mqtt.MessageHandler {
 	return func(client mqtt.Client, msg mqtt.Message) {
-		var sourceMessage SourceTriggerMessage
-		err := json.Unmarshal(msg.Payload(), &sourceMessage)
+		sourceMessage, err := parseSourceTriggerMessage(msg.Payload())
 		if err != nil {
 			log.Println("Failed to read rtl_433 event message: ", err, "\nMessage: ", string(msg.Payload()[:]))
+			return
+		}
+		// Receivers are told apart by topic, so each should publish to its own
+		sourceMessage.Receiver = msg.Topic()
+
+		triggerKey, discovery, ok := config.Snapshot().messages.findTrigger(sourceMessage)
+		dedupeKey, profile := triggerKey, discovery.profile
+		if !ok {
+			dedupeKey, _ = sourceMessage.profileSourceKey(config.Profiles)
+			profile = config.Profiles.forModel(sourceMessage.Model)
+		}
+		if len(dedupeKey) != 0 && !dedupe.accept(dedupeKey, sourceMessage.Receiver, profile) {
+			return
 		}
 
-		discovery, ok := mqttRoutes.triggers[sourceMessage.Id]
 		if ok {
-			if !discovery.holdSupported {
-				publishMessage(client, discovery, buttonShortPress)
-			} else {
-				lock, _ := longHold.locks.LoadOrStore(sourceMessage.Id, &sync.Mutex{})
-				lock.Lock()
-				state, ok := longHold.triggers[sourceMessage.Id]
-				var newTriggerState triggerLongHoldState
-				if !ok {
-					newTriggerState = triggerLongHoldState{
-						triggerHash:    rand.Int(),
-						firstTriggered: time.Now(),
-						count:          1,
-					}
-				} else {
-					shouldSendLongPress := !state.sentLongPress && state.firstTriggered.Add(300*time.Millisecond).Before(time.Now())
-					if shouldSendLongPress {
-						log.Println("Starting long press")
-						publishMessage(client, discovery, buttonLongPress)
-					}
-					newTriggerState = triggerLongHoldState{
-						triggerHash:    rand.Int(),
-						firstTriggered: state.firstTriggered,
-						count:          state.count + 1,
-						sentLongPress:  state.sentLongPress || shouldSendLongPress,
-					}
-				}
-				longHold.triggers[sourceMessage.Id] = newTriggerState
-				lock.Unlock()
-				go waitLongHold(client, sourceMessage.Id, discovery, newTriggerState.triggerHash)
-			}
+			gestures.signal(triggerKey, discovery, sourceMessage.Receiver)
 		} else {
 			pairingChannel := *pairing.Channel
 			if pairingChannel != nil && !pairing.closing.Load() {
@@ -170,71 +239,210 @@ func rtl433EventHandler(mqttRoutes *mqttMessages, pairing PairingState) mqtt.Mes
 				pairingChannel <- sourceMessage
 				pairing.sending.Add(-1)
 			} else {
-				log.Println("Received unmatched device ID: ", sourceMessage.Id)
+				log.Println("Received unmatched device: ", sourceMessage.Model, " ", sourceMessage.Fields["id"], " from ", sourceMessage.Receiver)
+				inbox.record(sourceMessage, config.Profiles)
 			}
 		}
 	}
 }
 
-func waitLongHold(client mqtt.Client, sourceId SourceTriggerId, discovery triggerMessages, triggerHash int) {
-	time.Sleep(150 * time.Millisecond)
-	lock, _ := longHold.locks.Load(sourceId)
-	lock.Lock()
-	defer lock.Unlock()
-	triggerState, ok := longHold.triggers[sourceId]
-	if ok && triggerState.triggerHash == triggerHash {
-		log.Println("No trigger response after 150 ms")
-		if triggerState.sentLongPress {
-			publishMessage(client, discovery, buttonLongRelease)
-		} else if triggerState.count > 1 {
-			publishMessage(client, discovery, buttonShortPress)
-		} else {
-			log.Println("Only received 1 signal for trigger, ignoring")
+// Longest random wait before republishing discovery after Home Assistant comes online.
+// Spreads out the load when many integrations republish at once.
+const birthRepublishMaxDelay = 5 * time.Second
+
+// Republishes all discovery messages when Home Assistant restarts, in case its retained state was lost.
+func haStatusHandler(config ConfigState) mqtt.MessageHandler {
+	var pending atomic.Bool
+	return func(client mqtt.Client, msg mqtt.Message) {
+		if msg.Retained() || string(msg.Payload()) != payloadOnline {
+			// A retained birth message is from before we connected, discovery was just published on connect
+			return
 		}
-		delete(longHold.triggers, sourceId)
+		if !pending.CompareAndSwap(false, true) {
+			return
+		}
+		delay := rand.N(birthRepublishMaxDelay)
+		log.Println("Home Assistant is online, republishing discovery in", delay)
+		time.AfterFunc(delay, func() {
+			pending.Store(false)
+			PublishAllDiscovery(config, client)
+		})
+	}
+}
+
+type triggerActivation struct {
+	discovery   triggerMessages
+	triggerType string
+	receiver    string
+}
+
+// Publishes trigger activations in order from a single goroutine so the gesture engine never waits on the broker.
+func startTriggerPublisher(client mqtt.Client) func(discovery triggerMessages, triggerType string, receiver string) {
+	activations := make(chan triggerActivation, 100)
+	go func() {
+		for activation := range activations {
+			publishMessage(client, activation.discovery, activation.triggerType, activation.receiver)
+		}
+	}()
+	return func(discovery triggerMessages, triggerType string, receiver string) {
+		activations <- triggerActivation{discovery, triggerType, receiver}
 	}
 }
 
-func publishMessage(client mqtt.Client, triggerMessage triggerMessages, actionType string) {
+func publishAvailability(client mqtt.Client, payload string) {
+	token := client.Publish(availabilityTopic, 1, true, payload)
+	if !token.WaitTimeout(1*time.Second) || token.Error() != nil {
+		log.Println("Failed to publish bridge availability: ", token.Error())
+	}
+}
+
+func publishMessage(client mqtt.Client, triggerMessage triggerMessages, actionType string, receiver string) {
 	token := client.Publish(triggerMessage.triggerTopic, 1, false, actionType)
 	if !token.WaitTimeout(1*time.Second) || token.Error() != nil {
-		log.Println("Error publishing trigger activation: ", triggerMessage.triggerId)
+		log.Println("Error publishing trigger activation: ", triggerMessage.triggerId, " ", actionType, " from ", receiver)
 	} else {
-		log.Println("Republished trigger activation to HA: ", triggerMessage.triggerId)
+		log.Println("Republished trigger activation to HA: ", triggerMessage.triggerId, " ", actionType, " from ", receiver)
 	}
 }
 
 type inflightPublish struct {
-	token     mqtt.Token
-	triggerId string
+	token mqtt.Token
+	topic string
 }
 
 func PublishAllDiscovery(config ConfigState, client mqtt.Client) {
+	publishDiscoveryMessages(client, config.Snapshot().messages.allDiscoveryMessages())
+}
 
-	client.AddRoute(config.EnvVars.HaDiscoveryPrefix+"/device_automation/#/config", func(c mqtt.Client, msg mqtt.Message) {
-		log.Println("Existing triggers: ", strings.Split(msg.Topic(), "/")[2])
-		// TODO: Remove existing triggers that doesn't exist in config anymore. Can be done by sending 0 byte message to the topic.
-	})
-
+func publishDiscoveryMessages(client mqtt.Client, discoveryMessages map[discoveryTopic]DiscoveryMessage) {
 	tokens := make([]inflightPublish, 0)
-	for _, triggerMsg := range config.mqttMessages.triggers {
-		for topic, discovery := range triggerMsg.discoveryMessages {
-			log.Println("Publishing discovery: ", topic)
-			payload, err := json.Marshal(discovery)
-			if err != nil {
-				log.Println("Failed to serialize json: ", err)
-			}
-			tokens = append(tokens, inflightPublish{
-				token:     client.Publish(topic, 1, true, payload),
-				triggerId: triggerMsg.triggerId,
-			})
+	for topic, discovery := range discoveryMessages {
+		log.Println("Publishing discovery: ", topic)
+		payload, err := json.Marshal(discovery)
+		if err != nil {
+			log.Println("Failed to serialize json: ", err)
 		}
+		tokens = append(tokens, inflightPublish{
+			token: client.Publish(topic, 1, true, payload),
+			topic: topic,
+		})
 	}
 
 	for _, token := range tokens {
 		if !token.token.WaitTimeout(1*time.Second) || token.token.Error() != nil {
-			log.Println("Failed to publish trigger discovery: ", token.triggerId, " ", token.token.Error())
+			log.Println("Failed to publish trigger discovery: ", token.topic, " ", token.token.Error())
+		}
+	}
+}
+
+// Publishes discovery messages that are added or changed and clears those that are removed.
+func publishDiscoveryDiff(client mqtt.Client, oldMessages mqttMessages, newMessages mqttMessages) {
+	oldDiscovery := oldMessages.allDiscoveryMessages()
+	newDiscovery := newMessages.allDiscoveryMessages()
+
+	changedDiscovery := make(map[discoveryTopic]DiscoveryMessage)
+	for topic, discovery := range newDiscovery {
+		previous, ok := oldDiscovery[topic]
+		if !ok || !reflect.DeepEqual(previous, discovery) {
+			changedDiscovery[topic] = discovery
+		}
+	}
+	removedTopics := make([]discoveryTopic, 0)
+	for topic := range oldDiscovery {
+		if _, ok := newDiscovery[topic]; !ok {
+			removedTopics = append(removedTopics, topic)
 		}
 	}
 
+	if len(changedDiscovery) != 0 {
+		publishDiscoveryMessages(client, changedDiscovery)
+	}
+	if len(removedTopics) != 0 {
+		clearDiscoveryTopics(client, removedTopics)
+	}
+}
+
+func clearDiscoveryTopics(client mqtt.Client, topics []discoveryTopic) {
+	tokens := make([]inflightPublish, 0)
+	for _, topic := range topics {
+		log.Println("Clearing discovery: ", topic)
+		tokens = append(tokens, inflightPublish{
+			token: client.Publish(topic, 1, true, []byte{}),
+			topic: topic,
+		})
+	}
+
+	for _, token := range tokens {
+		if !token.token.WaitTimeout(1*time.Second) || token.token.Error() != nil {
+			log.Println("Failed to clear trigger discovery: ", token.topic, " ", token.token.Error())
+		}
+	}
+}
+
+// Time given to the broker to deliver all retained discovery messages after subscribing.
+const retainedCollectionWindow = 2 * time.Second
+
+// Collects our retained discovery messages from the broker and clears those that are no longer in config.
+func ReconcileDiscovery(config ConfigState, client mqtt.Client) {
+	retainedTopics := collectOwnDiscoveryTopics(config, client)
+
+	expectedDiscovery := config.Snapshot().messages.allDiscoveryMessages()
+
+	staleTopics := make([]discoveryTopic, 0)
+	for _, topic := range retainedTopics {
+		if _, ok := expectedDiscovery[topic]; !ok {
+			staleTopics = append(staleTopics, topic)
+		}
+	}
+	if len(staleTopics) == 0 {
+		log.Println("No stale discovery messages found")
+		return
+	}
+	log.Println("Removing", len(staleTopics), "triggers that no longer exist in config")
+	clearDiscoveryTopics(client, staleTopics)
+}
+
+// Clears all our retained discovery messages, including those of triggers still in config.
+func PurgeDiscovery(config ConfigState, client mqtt.Client) int {
+	retainedTopics := collectOwnDiscoveryTopics(config, client)
+	if len(retainedTopics) != 0 {
+		clearDiscoveryTopics(client, retainedTopics)
+	}
+	return len(retainedTopics)
+}
+
+// Subscribes to retained discovery messages and returns the topics of those published by us.
+func collectOwnDiscoveryTopics(config ConfigState, client mqtt.Client) []discoveryTopic {
+	var lock sync.Mutex
+	retainedTopics := make([]discoveryTopic, 0)
+
+	discoveryFilter := getDiscoveryNodeTopic(config.EnvVars) + "/+/config"
+	token := client.Subscribe(discoveryFilter, 1, func(c mqtt.Client, msg mqtt.Message) {
+		if !msg.Retained() || len(msg.Payload()) == 0 {
+			return
+		}
+		var discovery DiscoveryMessage
+		err := json.Unmarshal(msg.Payload(), &discovery)
+		if err != nil || !strings.HasPrefix(discovery.Topic, rootTopic+"/") {
+			// Not ours, another rtl_433 integration may be using the same node id
+			return
+		}
+		lock.Lock()
+		retainedTopics = append(retainedTopics, msg.Topic())
+		lock.Unlock()
+	})
+	if !token.WaitTimeout(1*time.Second) || token.Error() != nil {
+		log.Println("Failed to subscribe to existing discovery messages: ", token.Error())
+		return retainedTopics
+	}
+
+	time.Sleep(retainedCollectionWindow)
+
+	if token := client.Unsubscribe(discoveryFilter); !token.WaitTimeout(1*time.Second) || token.Error() != nil {
+		log.Println("Failed to unsubscribe from existing discovery messages: ", token.Error())
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	return retainedTopics
 }
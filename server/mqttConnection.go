@@ -0,0 +1,82 @@
+package server
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+type MqttConnectionState string
+
+const (
+	MqttConnecting   MqttConnectionState = "connecting"
+	MqttConnected    MqttConnectionState = "connected"
+	MqttDisconnected MqttConnectionState = "disconnected"
+)
+
+const maxConnectBackoff = time.Minute
+
+type MqttStatus struct {
+	State MqttConnectionState
+	Since time.Time
+	// Reason of the last failed connection attempt or connection loss
+	LastError string
+}
+
+// Broker connection of the server, kept up by reconnecting in the background.
+type MqttConnection struct {
+	Client mqtt.Client
+	lock   sync.Mutex
+	status MqttStatus
+}
+
+func newMqttConnection() *MqttConnection {
+	return &MqttConnection{
+		status: MqttStatus{State: MqttConnecting, Since: time.Now()},
+	}
+}
+
+func (m *MqttConnection) Status() MqttStatus {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.status
+}
+
+func (m *MqttConnection) setStatus(state MqttConnectionState, err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.status.State != state {
+		m.status.State = state
+		m.status.Since = time.Now()
+	}
+	if err != nil {
+		m.status.LastError = err.Error()
+	}
+}
+
+// Retries the initial connection with exponential backoff. Once connected, paho reconnects on its own.
+func (m *MqttConnection) connectWithBackoff(broker string) {
+	backoff := time.Second
+	for {
+		token := m.Client.Connect()
+		token.Wait()
+		if token.Error() == nil {
+			return
+		}
+		log.Println("Failed to connect to", broker, "retrying in", backoff, "error:", token.Error())
+		m.setStatus(MqttDisconnected, token.Error())
+		time.Sleep(backoff)
+		backoff = min(2*backoff, maxConnectBackoff)
+		m.setStatus(MqttConnecting, nil)
+	}
+}
+
+// Marks the bridge offline before disconnecting, as the broker only sends the last will on unexpected disconnects.
+func (m *MqttConnection) Close() {
+	if m.Client.IsConnected() {
+		publishAvailability(m.Client, payloadOffline)
+	}
+	m.Client.Disconnect(1000)
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Credentials and TLS settings of the broker connection. TLS is used for mqtts:// and ssl:// brokers.
+type MqttAuth struct {
+	Username string
+	Password string
+	// Read instead of Password if set, e.g. a docker secret
+	PasswordFile       string
+	CaFile             string
+	ClientCertFile     string
+	ClientKeyFile      string
+	InsecureSkipVerify bool
+}
+
+// Allows for slow TLS handshakes.
+const connectTimeout = 10 * time.Second
+
+func newMqttClientOptions(envVars EnvVars, clientId string) (*mqtt.ClientOptions, error) {
+	opts := mqtt.NewClientOptions()
+	opts.AddBroker(envVars.MqttBroker)
+	opts.SetClientID(clientId)
+	opts.SetOrderMatters(false)
+	opts.SetConnectTimeout(connectTimeout)
+
+	auth := envVars.MqttAuth
+	if len(auth.Username) != 0 {
+		opts.SetUsername(auth.Username)
+	}
+	password, err := auth.password()
+	if err != nil {
+		return nil, err
+	}
+	if len(password) != 0 {
+		opts.SetPassword(password)
+	}
+
+	tlsConfig, err := auth.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		opts.SetTLSConfig(tlsConfig)
+	}
+	return opts, nil
+}
+
+func (a MqttAuth) password() (string, error) {
+	if len(a.PasswordFile) == 0 {
+		return a.Password, nil
+	}
+	password, err := os.ReadFile(a.PasswordFile)
+	if err != nil {
+		return "", fmt.Errorf("Failed to read MQTT password file: %w", err)
+	}
+	return strings.TrimRight(string(password), "\r\n"), nil
+}
+
+// Returns nil if nothing is configured, so the default TLS config of the client is used.
+func (a MqttAuth) tlsConfig() (*tls.Config, error) {
+	if len(a.CaFile) == 0 && len(a.ClientCertFile) == 0 && len(a.ClientKeyFile) == 0 && !a.InsecureSkipVerify {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: a.InsecureSkipVerify,
+	}
+
+	if len(a.CaFile) != 0 {
+		caBundle, err := os.ReadFile(a.CaFile)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read MQTT CA file: %w", err)
+		}
+		certPool := x509.NewCertPool()
+		if !certPool.AppendCertsFromPEM(caBundle) {
+			return nil, errors.New("No certificates found in MQTT CA file " + a.CaFile)
+		}
+		tlsConfig.RootCAs = certPool
+	}
+
+	if len(a.ClientCertFile) != 0 || len(a.ClientKeyFile) != 0 {
+		if len(a.ClientCertFile) == 0 || len(a.ClientKeyFile) == 0 {
+			return nil, errors.New("Both MQTT client certificate and key files are required")
+		}
+		clientCert, err := tls.LoadX509KeyPair(a.ClientCertFile, a.ClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to load MQTT client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{clientCert}
+	}
+	return tlsConfig, nil
+}
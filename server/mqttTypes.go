@@ -4,7 +4,7 @@ type discoveryTopic = string
 
 type triggerMessages struct {
 	triggerId         string
-	holdSupported     bool
+	profile           ModelProfile
 	triggerTopic      string
 	discoveryMessages map[discoveryTopic]DiscoveryMessage
 }
@@ -12,10 +12,17 @@ type triggerMessages struct {
 type DiscoveryMessage struct {
 	AutomationType string                 `json:"automation_type"` // trigger
 	Type           string                 `json:"type"`            // button_short_press
-	Payload        *string `json:"payload"`
+	Payload        *string                `json:"payload"`
 	SubType        string                 `json:"subtype"`
 	Topic          string                 `json:"topic"`
 	Device         DeviceDiscoveryMessage `json:"device"`
+	Availability   []AvailabilityMessage  `json:"availability"`
+}
+
+type AvailabilityMessage struct {
+	Topic               string `json:"topic"`
+	PayloadAvailable    string `json:"payload_available"`
+	PayloadNotAvailable string `json:"payload_not_available"`
 }
 
 type DeviceDiscoveryMessage struct {
@@ -25,5 +32,31 @@ type DeviceDiscoveryMessage struct {
 }
 
 type mqttMessages struct {
-	triggers map[SourceTriggerId]triggerMessages
+	triggers map[sourceKey]triggerMessages
+	// Distinct sets of identity fields used by the triggers, most specific first
+	identities [][]string
+}
+
+func (m *mqttMessages) findTrigger(sourceMessage SourceTriggerMessage) (sourceKey, triggerMessages, bool) {
+	for _, identityFields := range m.identities {
+		sourceId, ok := sourceMessage.sourceId(identityFields)
+		if !ok {
+			continue
+		}
+		triggerKey := getSourceKey(sourceMessage.Model, identityFields, sourceId)
+		if triggerMsg, ok := m.triggers[triggerKey]; ok {
+			return triggerKey, triggerMsg, true
+		}
+	}
+	return "", triggerMessages{}, false
+}
+
+func (m *mqttMessages) allDiscoveryMessages() map[discoveryTopic]DiscoveryMessage {
+	discoveryMessages := make(map[discoveryTopic]DiscoveryMessage)
+	for _, triggerMsg := range m.triggers {
+		for topic, discovery := range triggerMsg.discoveryMessages {
+			discoveryMessages[topic] = discovery
+		}
+	}
+	return discoveryMessages
 }
@@ -1,7 +1,9 @@
 package server
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"log"
 	"sync"
 	"sync/atomic"
@@ -9,19 +11,28 @@ import (
 )
 
 type PairingState struct {
-	Channel         *chan SourceTriggerMessage
-	sending         *atomic.Int32
-	closing         *atomic.Bool // Sent by receiver
-	lock            *sync.Mutex
+	Channel  *chan SourceTriggerMessage
+	sending  *atomic.Int32
+	closing  *atomic.Bool // Sent by receiver
+	lock     *sync.Mutex
+	progress *pairingProgressBroadcaster
+	cancel   *pairingCancel
+}
+
+type pairingCancel struct {
+	lock   sync.Mutex
+	cancel context.CancelFunc
 }
 
 func InitPairing() PairingState {
 	var emptyChan chan SourceTriggerMessage
 	return PairingState{
-		Channel:         &emptyChan,
-		sending:         &atomic.Int32{},
-		closing:         &atomic.Bool{},
-		lock:            &sync.Mutex{},
+		Channel:  &emptyChan,
+		sending:  &atomic.Int32{},
+		closing:  &atomic.Bool{},
+		lock:     &sync.Mutex{},
+		progress: newPairingProgressBroadcaster(),
+		cancel:   &pairingCancel{},
 	}
 }
 
@@ -52,80 +63,169 @@ func resetPairing(pairing PairingState) {
 	pairing.lock.Unlock()
 }
 
+// Stops the pairing session in progress, if any.
+func CancelPairing(pairing PairingState) error {
+	pairing.cancel.lock.Lock()
+	defer pairing.cancel.lock.Unlock()
+	if pairing.cancel.cancel == nil {
+		return ErrNoPairingInProgress
+	}
+	log.Println("Cancelling pairing")
+	pairing.cancel.cancel()
+	return nil
+}
+
+func setPairingCancel(pairing PairingState, cancel context.CancelFunc) {
+	pairing.cancel.lock.Lock()
+	defer pairing.cancel.lock.Unlock()
+	pairing.cancel.cancel = cancel
+}
+
 type triggerTracker struct {
 	deviceModel      string
 	consecutiveCount uint8
 	lastTriggered    time.Time
 }
 
-func StartPairing(deviceId string, triggerSubType string, config ConfigState, pairing PairingState) (*Trigger, error) {
-	device := findDevice(*config.DevConf, deviceId)
+func StartPairing(
+	deviceId string,
+	triggerSubType string,
+	identityFields []string,
+	config ConfigState,
+	pairing PairingState) (*Trigger, error) {
+	// Checked before pairing so the presses are not wasted
+	if err := checkSubType(triggerSubType); err != nil {
+		return nil, err
+	}
+	device := findDevice(config.Snapshot().DevConf, deviceId)
+	if device == nil {
+		return nil, fmt.Errorf("%w: %s", ErrDeviceNotFound, deviceId)
+	}
+
+	return captureTrigger(*device, identityFields, config.EnvVars.PairingTimeout, pairing,
+		func(sourceId SourceTriggerId, deviceModel string) (*Trigger, error) {
+			return AddTrigger(config, deviceId, triggerSubType, sourceId, identityFields, deviceModel)
+		})
+}
+
+// Pairs an existing trigger to a new physical remote. Only the source ID is replaced so the trigger ID and HA automations remain.
+func StartRepairing(deviceId string, triggerId string, config ConfigState, pairing PairingState) (*Trigger, error) {
+	snapshot := config.Snapshot()
+	device := findDevice(snapshot.DevConf, deviceId)
 	if device == nil {
-		return nil, errors.New("Device not found: " + deviceId)
+		return nil, fmt.Errorf("%w: %s", ErrDeviceNotFound, deviceId)
 	}
+	trigger := findTrigger(snapshot.DevConf, deviceId, triggerId)
+	if trigger == nil {
+		return nil, fmt.Errorf("%w: %s", ErrTriggerNotFound, triggerId)
+	}
+
+	return captureTrigger(*device, trigger.getIdentityFields(), config.EnvVars.PairingTimeout, pairing,
+		func(sourceId SourceTriggerId, deviceModel string) (*Trigger, error) {
+			return UpdateTriggerSource(config, deviceId, triggerId, sourceId, deviceModel)
+		})
+}
 
+// Waits for a trigger that is pressed 3 times consecutively and saves it with its source ID and model.
+// Success is only reported once saved, as the source may have been paired elsewhere in the meantime.
+func captureTrigger(
+	device Device,
+	identityFields []string,
+	timeout time.Duration,
+	pairing PairingState,
+	save func(sourceId SourceTriggerId, deviceModel string) (*Trigger, error)) (*Trigger, error) {
 	success := createPairingChannel(pairing)
 	if !success {
-		return nil, errors.New("Another pairing in progress")
+		return nil, ErrPairingInProgress
 	}
 	defer resetPairing(pairing)
 
-	startClosing := make(chan bool)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	setPairingCancel(pairing, cancel)
+	defer func() {
+		setPairingCancel(pairing, nil)
+		cancel()
+	}()
 
 	trackers := make(map[SourceTriggerId]triggerTracker)
 	var selectedTracker *SourceTriggerId
+	progress := PairingProgress{
+		Status:        PairingWaiting,
+		ExpectedModel: device.Model,
+		Candidates:    []PairingCandidate{},
+		IgnoredModels: []string{},
+	}
+	pairing.progress.publish(progress)
 
-	go func() {
-		time.Sleep(20 * time.Second)
-		startClosing <- true
-	}()
-
-	loop:
+loop:
 	for {
 		select {
 		case trigger := <-*pairing.Channel:
 			if len(device.Model) != 0 && device.Model != trigger.Model {
 				log.Println("Ignoring trigger due to model mismatch")
+				progress.IgnoredModels = addIgnoredModel(progress.IgnoredModels, trigger.Model)
+				pairing.progress.publish(progress)
 				continue loop
 			}
-			tracked, ok := trackers[trigger.Id]
+			sourceId, ok := trigger.sourceId(identityFields)
 			if !ok {
-				trackers[trigger.Id] = triggerTracker{
-					deviceModel:      trigger.Model,
-					consecutiveCount: 1,
-					lastTriggered:    time.Now(),
-				}
+				log.Println("Ignoring trigger without identity fields: ", identityFields)
 				continue loop
 			}
-			if time.Now().Sub(tracked.lastTriggered) > 2*time.Second {
-				log.Println("Took too long for subsequent press")
-				trackers[trigger.Id] = triggerTracker{
-					deviceModel:      trigger.Model,
-					consecutiveCount: 1,
-					lastTriggered:    time.Now(),
+			tracked, ok := trackers[sourceId]
+			if !ok || time.Now().Sub(tracked.lastTriggered) > 2*time.Second {
+				if ok {
+					log.Println("Took too long for subsequent press")
 				}
-				continue loop
+				tracked = triggerTracker{}
 			}
-			trackers[trigger.Id] = triggerTracker{
+			trackers[sourceId] = triggerTracker{
 				deviceModel:      trigger.Model,
 				consecutiveCount: tracked.consecutiveCount + 1,
 				lastTriggered:    time.Now(),
 			}
-			if trackers[trigger.Id].consecutiveCount < 3 {
+			progress.Candidates = toPairingCandidates(trackers)
+			if trackers[sourceId].consecutiveCount < 3 {
+				pairing.progress.publish(progress)
 				continue loop
 			}
-			selectedTracker = &trigger.Id
+			selectedTracker = &sourceId
 			break loop
 
-		case <-startClosing:
+		case <-ctx.Done():
 			break loop
 		}
 	}
 
 	if selectedTracker == nil {
-		return nil, errors.New("No triggers paired")
+		if errors.Is(ctx.Err(), context.Canceled) {
+			progress.Status = PairingCancelled
+			pairing.progress.publish(progress)
+			return nil, ErrPairingCancelled
+		}
+		if len(progress.Candidates) == 0 && len(progress.IgnoredModels) != 0 {
+			progress.Status = PairingModelMismatch
+		} else {
+			progress.Status = PairingTimedOut
+		}
+		pairing.progress.publish(progress)
+		return nil, ErrNoTriggerPaired
 	}
 
-	trigger, _ := trackers[*selectedTracker]
-	return AddTrigger(config, deviceId, triggerSubType, *selectedTracker, trigger.deviceModel)
+	tracked, _ := trackers[*selectedTracker]
+	progress.Paired = &PairingCandidate{
+		SourceId: *selectedTracker,
+		Model:    tracked.deviceModel,
+		Presses:  tracked.consecutiveCount,
+	}
+	savedTrigger, err := save(*selectedTracker, tracked.deviceModel)
+	if err != nil {
+		progress.Status = PairingFailed
+		progress.Error = err.Error()
+		pairing.progress.publish(progress)
+		return nil, err
+	}
+	progress.Status = PairingSucceeded
+	pairing.progress.publish(progress)
+	return savedTrigger, nil
 }
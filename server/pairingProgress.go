@@ -0,0 +1,112 @@
+package server
+
+import (
+	"sort"
+	"sync"
+)
+
+type PairingStatus string
+
+const (
+	PairingWaiting       PairingStatus = "waiting"
+	PairingSucceeded     PairingStatus = "succeeded"
+	PairingTimedOut      PairingStatus = "timed_out"
+	PairingModelMismatch PairingStatus = "model_mismatch"
+	PairingCancelled     PairingStatus = "cancelled"
+	PairingFailed        PairingStatus = "failed"
+)
+
+type PairingCandidate struct {
+	SourceId SourceTriggerId `json:"sourceId"`
+	Model    string          `json:"model"`
+	Presses  uint8           `json:"presses"`
+}
+
+type PairingProgress struct {
+	Status        PairingStatus      `json:"status"`
+	ExpectedModel string             `json:"expectedModel"`
+	Candidates    []PairingCandidate `json:"candidates"`
+	// Models of signals ignored because they differ from the model of the device
+	IgnoredModels []string          `json:"ignoredModels"`
+	Paired        *PairingCandidate `json:"paired"`
+	// Why the paired trigger could not be saved
+	Error string `json:"error"`
+}
+
+func (p PairingProgress) Active() bool {
+	return p.Status == PairingWaiting
+}
+
+// Fans out progress of the pairing session to all subscribers, e.g. websocket connections of open pairing dialogs.
+type pairingProgressBroadcaster struct {
+	lock        sync.Mutex
+	latest      PairingProgress
+	subscribers map[chan PairingProgress]bool
+}
+
+func newPairingProgressBroadcaster() *pairingProgressBroadcaster {
+	return &pairingProgressBroadcaster{
+		subscribers: make(map[chan PairingProgress]bool),
+	}
+}
+
+func (b *pairingProgressBroadcaster) publish(progress PairingProgress) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.latest = progress
+	for subscriber := range b.subscribers {
+		select {
+		case subscriber <- progress:
+		default:
+			// Slow subscriber, it will catch up with the next update
+		}
+	}
+}
+
+// Returns the progress of the current pairing session, or of the last one if none is in progress.
+func CurrentPairingProgress(pairing PairingState) PairingProgress {
+	pairing.progress.lock.Lock()
+	defer pairing.progress.lock.Unlock()
+	return pairing.progress.latest
+}
+
+// Returns a channel of progress updates, starting with the current session if one is in progress, and a function to unsubscribe.
+func SubscribePairingProgress(pairing PairingState) (<-chan PairingProgress, func()) {
+	b := pairing.progress
+	subscriber := make(chan PairingProgress, 16)
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.latest.Active() {
+		subscriber <- b.latest
+	}
+	b.subscribers[subscriber] = true
+	return subscriber, func() {
+		b.lock.Lock()
+		defer b.lock.Unlock()
+		delete(b.subscribers, subscriber)
+	}
+}
+
+func toPairingCandidates(trackers map[SourceTriggerId]triggerTracker) []PairingCandidate {
+	candidates := make([]PairingCandidate, 0, len(trackers))
+	for sourceId, tracker := range trackers {
+		candidates = append(candidates, PairingCandidate{
+			SourceId: sourceId,
+			Model:    tracker.deviceModel,
+			Presses:  tracker.consecutiveCount,
+		})
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].SourceId < candidates[j].SourceId
+	})
+	return candidates
+}
+
+func addIgnoredModel(ignoredModels []string, model string) []string {
+	for _, ignored := range ignoredModels {
+		if ignored == model {
+			return ignoredModels
+		}
+	}
+	return append(ignoredModels, model)
+}
@@ -0,0 +1,64 @@
+package server
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// Presses the remote 3 times once pairing is waiting, as the rtl_433 event handler would.
+func pressToPair(t *testing.T, pairing PairingState, sourceMessage SourceTriggerMessage) {
+	t.Helper()
+	for !CurrentPairingProgress(pairing).Active() {
+		time.Sleep(time.Millisecond)
+	}
+	for range 3 {
+		*pairing.Channel <- sourceMessage
+	}
+}
+
+func TestPairingSavesTrigger(t *testing.T) {
+	config := newTestConfig(t)
+	config.EnvVars.PairingTimeout = 5 * time.Second
+	pairing := InitPairing()
+	device, err := AddDevice(config, "Living room")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go pressToPair(t, pairing, SourceTriggerMessage{Model: "remote", Fields: map[string]string{"id": "1234"}})
+	trigger, err := StartPairing(device.Id, "button_1", defaultIdentityFields, config, pairing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if trigger.SourceId != "1234" {
+		t.Errorf("Expected source 1234, got %s", trigger.SourceId)
+	}
+	if progress := CurrentPairingProgress(pairing); progress.Status != PairingSucceeded {
+		t.Errorf("Expected pairing to succeed, got %s", progress.Status)
+	}
+}
+
+func TestPairingReportsFailedSave(t *testing.T) {
+	config := newTestConfig(t)
+	config.EnvVars.PairingTimeout = 5 * time.Second
+	pairing := InitPairing()
+	device, err := AddDevice(config, "Living room")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := AddManualTrigger(config, device.Id, "button_1", "1234", nil, "remote"); err != nil {
+		t.Fatal(err)
+	}
+
+	go pressToPair(t, pairing, SourceTriggerMessage{Model: "remote", Fields: map[string]string{"id": "1234"}})
+	_, err = StartPairing(device.Id, "button_2", defaultIdentityFields, config, pairing)
+	var duplicateSource *DuplicateSourceError
+	if !errors.As(err, &duplicateSource) {
+		t.Errorf("Expected a duplicate source error, got %v", err)
+	}
+	progress := CurrentPairingProgress(pairing)
+	if progress.Status != PairingFailed || len(progress.Error) == 0 {
+		t.Errorf("Expected pairing to fail with an error, got %s %q", progress.Status, progress.Error)
+	}
+}
@@ -0,0 +1,186 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"os"
+	"path"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Describes how a remote model behaves and which trigger types it supports.
+type ModelProfile struct {
+	Model string `yaml:"model"`
+	// The remote repeats its signal while a button is held, presses are only complete once the signals stop
+	Repeats bool `yaml:"repeats"`
+	// How long signals must keep repeating before a long press is sent
+	HoldThreshold time.Duration `yaml:"holdThreshold"`
+	// How long without signals before the button is considered released
+	ReleaseTimeout time.Duration `yaml:"releaseTimeout"`
+	// Presses with fewer signals than this are ignored as noise
+	MinSignals uint `yaml:"minSignals"`
+	// How long to wait for another press before sending the presses so far as a single, double, triple press...
+	MultiPressWindow time.Duration `yaml:"multiPressWindow"`
+	TriggerTypes     []string      `yaml:"triggerTypes"`
+	IdentityFields   []string      `yaml:"identityFields"`
+}
+
+// Format of CONFIG_DIR/profiles.yml, see the README for an example.
+type profilesFile struct {
+	Profiles []ModelProfile `yaml:"profiles"`
+}
+
+type ProfileRegistry struct {
+	profiles       map[string]ModelProfile
+	defaultProfile ModelProfile
+}
+
+// Used in profiles.yml to override the profile of models without a profile.
+const defaultProfileModel = "*"
+
+var defaultProfile = ModelProfile{
+	Model:            defaultProfileModel,
+	Repeats:          false,
+	HoldThreshold:    300 * time.Millisecond,
+	ReleaseTimeout:   150 * time.Millisecond,
+	MinSignals:       1,
+	MultiPressWindow: 400 * time.Millisecond,
+	TriggerTypes:     []string{buttonShortPress},
+	IdentityFields:   defaultIdentityFields,
+}
+
+var builtinProfiles = []ModelProfile{
+	{
+		Model:            "Brandless remote",
+		Repeats:          true,
+		HoldThreshold:    300 * time.Millisecond,
+		ReleaseTimeout:   150 * time.Millisecond,
+		MinSignals:       2,
+		MultiPressWindow: 400 * time.Millisecond,
+		TriggerTypes:     []string{buttonShortPress, buttonLongPress, buttonLongRelease},
+		IdentityFields:   defaultIdentityFields,
+	},
+}
+
+func getProfilesFile(envVars EnvVars) string {
+	return path.Join(envVars.ConfigDir, "profiles.yml")
+}
+
+// Loads the built-in profiles, overridden by those in profiles.yml if it exists.
+func loadProfiles(profilesFilePath string) (ProfileRegistry, error) {
+	registry := ProfileRegistry{
+		profiles:       make(map[string]ModelProfile),
+		defaultProfile: defaultProfile,
+	}
+	for _, profile := range builtinProfiles {
+		registry.profiles[profile.Model] = profile
+	}
+
+	profilesLoad, err := os.ReadFile(profilesFilePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return registry, nil
+	}
+	if err != nil {
+		return registry, err
+	}
+	log.Println("Loading model profiles from: ", profilesFilePath)
+	var loadedProfiles profilesFile
+	err = yaml.UnmarshalStrict(profilesLoad, &loadedProfiles)
+	if err != nil {
+		return registry, err
+	}
+	for _, profile := range loadedProfiles.Profiles {
+		profile = profile.withDefaults()
+		if profile.Model == defaultProfileModel {
+			registry.defaultProfile = profile
+		} else {
+			registry.profiles[profile.Model] = profile
+		}
+	}
+	return registry, nil
+}
+
+func (p ModelProfile) withDefaults() ModelProfile {
+	if p.HoldThreshold == 0 {
+		p.HoldThreshold = defaultProfile.HoldThreshold
+	}
+	if p.ReleaseTimeout == 0 {
+		p.ReleaseTimeout = defaultProfile.ReleaseTimeout
+	}
+	if p.MinSignals == 0 {
+		p.MinSignals = 1
+	}
+	if p.MultiPressWindow == 0 {
+		p.MultiPressWindow = defaultProfile.MultiPressWindow
+	}
+	if len(p.IdentityFields) == 0 {
+		p.IdentityFields = defaultIdentityFields
+	}
+
+	triggerTypes := make([]string, 0)
+	for _, triggerType := range p.TriggerTypes {
+		if !isKnownTriggerType(triggerType) {
+			log.Println("Ignoring unknown trigger type", triggerType, "for model", p.Model)
+			continue
+		}
+		if !p.Repeats && (triggerType == buttonLongPress || triggerType == buttonLongRelease) {
+			log.Println("Ignoring", triggerType, "for model", p.Model, "as it does not repeat signals")
+			continue
+		}
+		triggerTypes = append(triggerTypes, triggerType)
+	}
+	if len(triggerTypes) == 0 {
+		triggerTypes = defaultProfile.TriggerTypes
+	}
+	p.TriggerTypes = triggerTypes
+	return p
+}
+
+func (r ProfileRegistry) forModel(model string) ModelProfile {
+	profile, ok := r.profiles[model]
+	if !ok {
+		return r.defaultProfile
+	}
+	return profile
+}
+
+func (p ModelProfile) supports(triggerType string) bool {
+	for _, supported := range p.TriggerTypes {
+		if supported == triggerType {
+			return true
+		}
+	}
+	return false
+}
+
+// Highest number of consecutive presses with a supported trigger type.
+func (p ModelProfile) maxPresses() uint {
+	maxPresses := uint(1)
+	for idx, triggerType := range multiPressTypes {
+		if p.supports(triggerType) {
+			maxPresses = uint(idx + 1)
+		}
+	}
+	return maxPresses
+}
+
+// Trigger type for the number of consecutive presses, falling back to the highest supported count below it.
+func (p ModelProfile) pressType(count uint) string {
+	for idx := min(int(count), len(multiPressTypes)) - 1; idx > 0; idx-- {
+		if p.supports(multiPressTypes[idx]) {
+			return multiPressTypes[idx]
+		}
+	}
+	return buttonShortPress
+}
+
+// Identity fields to pair new triggers of the device with, based on the model of its existing triggers.
+func DefaultIdentityFields(conf ConfigState, deviceId string) []string {
+	device := findDevice(conf.Snapshot().DevConf, deviceId)
+	if device == nil {
+		return conf.Profiles.defaultProfile.IdentityFields
+	}
+	return conf.Profiles.forModel(device.Model).IdentityFields
+}
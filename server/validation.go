@@ -0,0 +1,75 @@
+package server
+
+import (
+	"fmt"
+)
+
+type TriggerRef struct {
+	DeviceId   string
+	DeviceName string
+	TriggerId  string
+	SubType    string
+}
+
+func (t TriggerRef) String() string {
+	return fmt.Sprintf("%s of %s (%s)", t.SubType, t.DeviceName, t.TriggerId)
+}
+
+func toTriggerRef(device Device, trigger Trigger) TriggerRef {
+	return TriggerRef{
+		DeviceId:   device.Id,
+		DeviceName: device.Name,
+		TriggerId:  trigger.Id,
+		SubType:    trigger.SubType,
+	}
+}
+
+// Two triggers with the same source ID, only the existing one would ever fire.
+type DuplicateSourceError struct {
+	SourceId  SourceTriggerId
+	Existing  TriggerRef
+	Duplicate TriggerRef
+}
+
+func (e *DuplicateSourceError) Error() string {
+	return fmt.Sprintf("Source ID %s of trigger %s is already used by trigger %s", e.SourceId, e.Duplicate, e.Existing)
+}
+
+// Returns the source ID conflicts between triggers in the config.
+func validateDeviceConfig(conf DeviceConfig) []error {
+	validationErrors := make([]error, 0)
+	seen := make(map[sourceKey]TriggerRef)
+	for _, device := range conf.Devices {
+		for _, trigger := range device.Triggers {
+			key := getSourceKey(device.Model, trigger.getIdentityFields(), trigger.SourceId)
+			if existing, ok := seen[key]; ok {
+				validationErrors = append(validationErrors, &DuplicateSourceError{
+					SourceId:  trigger.SourceId,
+					Existing:  existing,
+					Duplicate: toTriggerRef(device, trigger),
+				})
+				continue
+			}
+			seen[key] = toTriggerRef(device, trigger)
+		}
+	}
+	return validationErrors
+}
+
+// Returns an error if a trigger other than newTrigger already uses the source.
+func checkSourceUnused(
+	conf DeviceConfig,
+	deviceModel string,
+	identityFields []string,
+	sourceId SourceTriggerId,
+	newTrigger TriggerRef) error {
+	existingDevice, existingTrigger := findTriggerBySource(conf, deviceModel, identityFields, sourceId)
+	if existingTrigger != nil && existingTrigger.Id != newTrigger.TriggerId {
+		return &DuplicateSourceError{
+			SourceId:  sourceId,
+			Existing:  toTriggerRef(*existingDevice, *existingTrigger),
+			Duplicate: newTrigger,
+		}
+	}
+	return nil
+}